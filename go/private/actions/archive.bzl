@@ -61,6 +61,10 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
     # store __.PKGDEF and nogo facts in .x
     out_export = go.declare_file(go, name = source.library.name, ext = pre_ext + ".x")
     out_cgo_export_h = None  # set if cgo used in c-shared or c-archive mode
+    out_cgo_srcs = None  # set if cgo used for editors; Go files generated by cgo
+    out_embedcfg = None  # set if files are embedded for editors; resolved //go:embed patterns
+    if source.embedsrcs and go.mode.editor_outputs:
+        out_embedcfg = go.declare_file(go, name = source.library.name, ext = pre_ext + ".embedcfg")
 
     direct = [get_archive(dep) for dep in source.deps]
     runfiles = source.runfiles
@@ -90,6 +94,8 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
         )
         if go.mode.link in (LINKMODE_C_SHARED, LINKMODE_C_ARCHIVE):
             out_cgo_export_h = go.declare_file(go, path = "_cgo_install.h")
+        if go.mode.editor_outputs:
+            out_cgo_srcs = go.declare_directory(go, name = source.library.name, ext = pre_ext + ".cgo_srcs")
         cgo_deps = cgo.deps
         runfiles = runfiles.merge(cgo.runfiles)
         emit_compilepkg(
@@ -103,6 +109,8 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
             out_lib = out_lib,
             out_export = out_export,
             out_cgo_export_h = out_cgo_export_h,
+            out_cgo_srcs = out_cgo_srcs,
+            out_embedcfg = out_embedcfg,
             gc_goopts = source.gc_goopts,
             cgo = True,
             cgo_inputs = cgo.inputs,
@@ -126,6 +134,7 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
             archives = direct,
             out_lib = out_lib,
             out_export = out_export,
+            out_embedcfg = out_embedcfg,
             gc_goopts = source.gc_goopts,
             cgo = False,
             testfilter = testfilter,
@@ -171,6 +180,8 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
         export_file = out_export,
         data_files = as_tuple(data_files),
         _cgo_deps = as_tuple(cgo_deps),
+        _cgo_srcs = out_cgo_srcs,
+        _embedcfg = out_embedcfg,
     )
     x_defs = dict(source.x_defs)
     for a in direct:
@@ -49,6 +49,8 @@ def emit_compilepkg(
         out_lib = None,
         out_export = None,
         out_cgo_export_h = None,
+        out_cgo_srcs = None,
+        out_embedcfg = None,
         gc_goopts = [],
         testfilter = None):  # TODO: remove when test action compiles packages
     """Compiles a complete Go package."""
@@ -89,8 +91,16 @@ def emit_compilepkg(
     if out_cgo_export_h:
         args.add("-cgoexport", out_cgo_export_h)
         outputs.append(out_cgo_export_h)
+    if out_cgo_srcs:
+        args.add("-cgosrcs", out_cgo_srcs.path)
+        outputs.append(out_cgo_srcs)
+    if out_embedcfg:
+        args.add("-embedcfg", out_embedcfg)
+        outputs.append(out_embedcfg)
     if testfilter:
         args.add("-testfilter", testfilter)
+    if go.mode.pack_verify != "off":
+        args.add("-pack_verify", go.mode.pack_verify)
 
     gc_flags = list(gc_goopts)
     asm_flags = []
@@ -17,7 +17,8 @@ def emit_pack(
         in_lib = None,
         out_lib = None,
         objects = [],
-        archives = []):
+        archives = [],
+        verify = None):
     """See go/toolchains.rst#pack for full documentation."""
 
     if in_lib == None:
@@ -32,6 +33,10 @@ def emit_pack(
     args.add("-out", out_lib)
     args.add_all(objects, before_each = "-obj")
     args.add_all(archives, before_each = "-arc")
+    if verify == None:
+        verify = go.mode.pack_verify
+    if verify != "off":
+        args.add("-verify", verify)
 
     go.actions.run(
         inputs = inputs,
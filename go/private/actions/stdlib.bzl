@@ -49,6 +49,9 @@ def _should_use_sdk_stdlib(go):
             not go.mode.race and  # TODO(jayconrod): use precompiled race
             not go.mode.msan and
             not go.mode.pure and
+            not go.mode.debug and
+            not go.tags and  # the precompiled library was built without tags
+            not go.toolchain.flags.compile and
             go.mode.link == LINKMODE_NORMAL)
 
 def _build_stdlib_list_json(go):
@@ -78,9 +81,22 @@ def _build_stdlib(go):
     root_file = go.declare_file(go, path = "ROOT")
     args = go.builder_args(go, "stdlib")
     args.add("-out", root_file.dirname)
+
+    # Build tags are passed by builder_args. The flags below mirror the ones
+    # emit_compilepkg uses for packages outside the standard library.
+    gc_flags = []
+    asm_flags = []
     if go.mode.race:
-        args.add("-race")
-    args.add_all(link_mode_args(go.mode))
+        gc_flags.append("-race")
+    if go.mode.msan:
+        gc_flags.append("-msan")
+    if go.mode.debug:
+        gc_flags.extend(["-N", "-l"])
+    gc_flags.extend(go.toolchain.flags.compile)
+    gc_flags.extend(link_mode_args(go.mode))
+    asm_flags.extend(link_mode_args(go.mode))
+    args.add_all(gc_flags, before_each = "-gcflags")
+    args.add_all(asm_flags, before_each = "-asmflags")
     go.actions.write(root_file, "")
     env = go.env
     if go.mode.pure:
@@ -105,6 +121,13 @@ def _build_stdlib(go):
               [go.sdk.go, go.sdk.package_list, go.sdk.root_file] +
               go.crosstool)
     outputs = [pkg, src]
+
+    # TODO: declare an action per package, so that Bazel caches and executes
+    # standard library packages individually. This needs the package graph
+    # during analysis, which depends on the SDK version, the target platform
+    # and build tags. Until then, this one action lists packages with
+    # "go list -deps" and compiles each one with compilepkg, in parallel where
+    # the package graph allows, and is cached as a whole.
     go.actions.run(
         inputs = inputs,
         outputs = outputs,
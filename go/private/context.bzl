@@ -783,6 +783,8 @@ def _go_config_impl(ctx):
         linkmode = ctx.attr.linkmode[BuildSettingInfo].value,
         tags = ctx.attr.gotags[BuildSettingInfo].value,
         stamp = ctx.attr.stamp,
+        pack_verify = ctx.attr.pack_verify[BuildSettingInfo].value,
+        editor_outputs = ctx.attr.editor_outputs[BuildSettingInfo].value,
     )]
 
 go_config = rule(
@@ -821,6 +823,14 @@ go_config = rule(
             providers = [BuildSettingInfo],
         ),
         "stamp": attr.bool(mandatory = True),
+        "pack_verify": attr.label(
+            mandatory = True,
+            providers = [BuildSettingInfo],
+        ),
+        "editor_outputs": attr.label(
+            mandatory = True,
+            providers = [BuildSettingInfo],
+        ),
     },
     provides = [GoConfigInfo],
     doc = """Collects information about build settings in the current
@@ -76,6 +76,8 @@ def get_mode(ctx, go_toolchain, cgo_context_info, go_config_info):
     stamp = go_config_info.stamp if go_config_info else False
     debug = go_config_info.debug if go_config_info else False
     linkmode = go_config_info.linkmode if go_config_info else LINKMODE_NORMAL
+    pack_verify = go_config_info.pack_verify if go_config_info else "off"
+    editor_outputs = go_config_info.editor_outputs if go_config_info else False
     goos = go_toolchain.default_goos
     goarch = go_toolchain.default_goarch
 
@@ -107,6 +109,8 @@ def get_mode(ctx, go_toolchain, cgo_context_info, go_config_info):
         goos = goos,
         goarch = goarch,
         tags = tags,
+        pack_verify = pack_verify,
+        editor_outputs = editor_outputs,
     )
 
 def installsuffix(mode):
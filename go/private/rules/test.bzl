@@ -160,6 +160,13 @@ def _go_test_impl(ctx):
     env = {}
     for k, v in ctx.attr.env.items():
         env[k] = ctx.expand_location(v, ctx.attr.data)
+    if ctx.file.shard_timings:
+        env["GO_TEST_SHARD_TIMINGS"] = ctx.file.shard_timings.short_path
+        runfiles = runfiles.merge(ctx.runfiles(files = [ctx.file.shard_timings]))
+    if ctx.attr.case_output_limit:
+        env["GO_TEST_CASE_OUTPUT_LIMIT"] = str(ctx.attr.case_output_limit)
+    if ctx.attr.suite_output_limit:
+        env["GO_TEST_SUITE_OUTPUT_LIMIT"] = str(ctx.attr.suite_output_limit)
 
     # Bazel only looks for coverage data if the test target has an
     # InstrumentedFilesProvider. If the provider is found and at least one
@@ -268,6 +275,32 @@ _go_test_kwargs = {
             ***Note:*** This defaults to the package path.
             """,
         ),
+        "shard_timings": attr.label(
+            allow_single_file = True,
+            doc = """A file with the durations of the tests, used to balance tests across
+            shards when [shard_count] is set. Tests with a recorded duration are spread
+            so that each shard takes about as long, and other tests are assigned by a
+            hash of their name. Without it, tests are assigned round-robin.
+            <br><br>
+            The file can be generated from the `test.xml` files of a previous run with
+            `bazel run @io_bazel_rules_go//go/tools/shard_timings -- $(pwd)/bazel-testlogs/path/to/test/shard_*/test.xml > timings.txt`.
+            """,
+        ),
+        "case_output_limit": attr.int(
+            doc = """The number of bytes of the start and of the end of each output of a
+            test case kept in the `XML_OUTPUT_FILE`. The output in between is replaced
+            by a marker with its size. Sets `GO_TEST_CASE_OUTPUT_LIMIT` in the test
+            environment. If 0, 32768 bytes are kept.
+            """,
+        ),
+        "suite_output_limit": attr.int(
+            doc = """The number of bytes of output kept in the `XML_OUTPUT_FILE` in total,
+            for the test binary outside of test cases and for all test cases. Outputs
+            smaller than an equal share are kept whole, and the others share what
+            remains. Sets `GO_TEST_SUITE_OUTPUT_LIMIT` in the test environment. If 0,
+            1048576 bytes are kept.
+            """,
+        ),
         "x_defs": attr.string_dict(
             doc = """Map of defines to add to the go link command.
             See [Defines and stamping] for examples of how to use these.
@@ -425,18 +458,59 @@ _go_test_kwargs = {
     bazel run //path/to:test -- -test.bench=.
     ```<br><br>
     You can run specific tests by passing the `--test_filter=pattern
-    <test_filter_>` argument to Bazel. You can pass arguments to tests by passing
+    <test_filter_>` argument to Bazel. The pattern is a comma-separated list of
+    `-test.run` patterns, like `TestFoo/case_1,TestBar`; patterns starting with `-`
+    exclude the tests they match, like `-TestBar/slow` (this requires Go 1.20).
+    Before Go 1.20, when there are several patterns, only their top-level tests
+    are matched, and all of their subtests run.
+    Commas may be escaped with a backslash. You can pass arguments to tests by passing
     `--test_arg=arg <test_arg_>` arguments to Bazel, and you can set environment
     variables in the test environment by passing
     `--test_env=VAR=value <test_env_>`. You can terminate test execution after the first
     failure by passing the `--test_runner_fast_fast <test_runner_fail_fast_>` argument
     to Bazel. This is equivalent to passing `--test_arg=-failfast <test_arg_>`.<br><br>
     To write structured testlog information to Bazel's `XML_OUTPUT_FILE`, tests
-    ran with `bazel test` execute using a wrapper. This functionality can be
-    disabled by setting `GO_TEST_WRAP=0` in the test environment. Additionally,
-    the testbinary can be invoked with `-test.v` by setting
-    `GO_TEST_WRAP_TESTV=1` in the test environment; this will result in the
-    `XML_OUTPUT_FILE` containing more granular data.<br><br>
+    ran with `bazel test` execute using a wrapper. The wrapper is configured with
+    these variables of the test environment:<br><br>
+    `GO_TEST_WRAP=0` disables the wrapper.<br><br>
+    `GO_TEST_WRAP_TESTV=1` runs the test binary with `-test.v`, so that the
+    `XML_OUTPUT_FILE` contains more granular data.<br><br>
+    `GO_TEST_WRAP_RERUN_FAILED=N` reruns the top-level tests that failed up to N
+    times. Tests that pass when rerun don't fail the target, and are reported with
+    a `flakyFailure` element in the `XML_OUTPUT_FILE`.<br><br>
+    `GO_TEST_CASE_OUTPUT_LIMIT` and `GO_TEST_SUITE_OUTPUT_LIMIT` set how much of
+    each output of a test case, and of all the output of the run together, is kept
+    in the `XML_OUTPUT_FILE`, like the `case_output_limit` and `suite_output_limit`
+    attributes.<br><br>
+    In the `XML_OUTPUT_FILE`, the `failure` element of a failed test holds the
+    message and `file:line` location of the first line it logged, test cases have
+    `parent`, `elapsed` and `skip_reason` properties, and benchmarks have their
+    measurements as properties.<br><br>
+    Shortly before the test times out, the wrapper sends `SIGQUIT` to the test
+    binary, so that the goroutine dump of a hanging test is reported in its
+    output. This happens 5% of `TEST_TIMEOUT` before it expires, but at least 1
+    and at most 10 seconds before. The wrapper then writes its reports, with the
+    running test reported as timed out, and exits with status 124.<br><br>
+    The wrapper creates Bazel's `TEST_PREMATURE_EXIT_FILE`, and only removes it
+    once the tests completed, so that a test binary exiting early with status 0
+    fails the test.<br><br>
+    The wrapper writes these files to the undeclared outputs:<br><br>
+    `test_output.log` holds the whole output of the tests.<br><br>
+    `test.json` holds the events of the test run, in the format of
+    `go test -json`.<br><br>
+    `goroutine_dump.txt` holds the goroutine dump of a test that timed out.<br><br>
+    `benchmarks.txt` holds the measurements of benchmarks, in the format read by
+    `benchstat`.<br><br>
+    To run a fuzz target, pass `--test_arg=-test.fuzz=FuzzName` to `bazel test`.
+    The seed corpus is read from `testdata/fuzz`, which must be listed in `data`.
+    Unless `-test.fuzztime` is set, fuzzing stops after half of the test timeout.
+    The generated corpus is written to `fuzz_cache` in the undeclared outputs. Bazel
+    clears them before each run, so the corpus isn't reused by later runs.
+    The testing package writes failing inputs to `testdata/fuzz` in the runfiles of
+    the test, so that directory must be writable; when the runfiles are symlinks
+    to the workspace, the inputs land in the source tree. They are then copied to
+    `fuzz_crashers` in the undeclared outputs and attached to the failure of the
+    fuzz target in the `XML_OUTPUT_FILE`.<br><br>
     ***Note:*** To interoperate cleanly with old targets generated by [Gazelle], `name`
     should be `go_default_test` for internal tests and
     `go_default_xtest` for external tests. Gazelle now generates
@@ -44,15 +44,34 @@ def _go_path_impl(ctx):
         mode_to_archive[mode] = depset(direct = direct, transitive = transitive)
 
     # Collect sources and data files from archives. Merge archives into packages.
+    # In module mode, packages are laid out by import path rather than
+    # package path (vendor directories are not used), without a src/ prefix.
+    module_mode = ctx.attr.mode == "module"
     pkg_map = {}  # map from package path to structs
+    module_groups = {}  # map from (repository, first path element) to import paths
     for mode, archives in mode_to_archive.items():
         for archive in as_iterable(archives):
             importpath, pkgpath = effective_importpath_pkgpath(archive)
             if importpath == "":
                 continue  # synthetic archive or inferred location
+            if module_mode:
+                # Vendored packages come from a different module than the
+                # rest of their repository. Group them by vendor directory
+                # and by the module root guessed from their import path, so
+                # packages from one vendored module share a go.mod file.
+                repo = archive.label.workspace_name
+                root = importpath.split("/")[0]
+                if pkgpath != importpath:
+                    vendor_dir = pkgpath
+                    if pkgpath.endswith("/" + importpath):
+                        vendor_dir = pkgpath[:len(pkgpath) - len(importpath)]
+                    repo = "vendor:" + vendor_dir
+                    root = _vendored_module_root(importpath)
+                module_groups.setdefault((repo, root), []).append(importpath)
+                pkgpath = importpath
             pkg = struct(
                 importpath = importpath,
-                dir = "src/" + pkgpath,
+                dir = pkgpath if module_mode else "src/" + pkgpath,
                 srcs = as_list(archive.orig_srcs),
                 data = as_list(archive.data_files),
                 pkgs = {mode: archive.file},
@@ -70,7 +89,7 @@ def _go_path_impl(ctx):
         for f in pkg.srcs:
             dst = pkg.dir + "/" + f.basename
             _add_manifest_entry(manifest_entries, manifest_entry_map, inputs, f, dst)
-    if ctx.attr.include_pkg:
+    if ctx.attr.include_pkg and not module_mode:
         for pkg in pkg_map.values():
             for mode, f in pkg.pkgs.items():
                 # TODO(jayconrod): include other mode attributes, e.g., race.
@@ -108,7 +127,7 @@ def _go_path_impl(ctx):
         out_short_path = out.short_path
         outputs = [out]
         out_file = out
-    elif ctx.attr.mode == "copy":
+    elif ctx.attr.mode in ("copy", "module"):
         out = ctx.actions.declare_directory(ctx.label.name)
         out_path = out.path
         out_short_path = out.short_path
@@ -130,6 +149,8 @@ def _go_path_impl(ctx):
     args.add("-manifest", manifest_file)
     args.add("-out", out_path)
     args.add("-mode", ctx.attr.mode)
+    if module_mode:
+        args.add_all(_module_roots(module_groups), before_each = "-module")
     ctx.actions.run(
         outputs = outputs,
         inputs = inputs,
@@ -187,6 +208,7 @@ go_path = rule(
                 "archive",
                 "copy",
                 "link",
+                "module",
             ],
             doc = """
             Determines how the generated directory is provided. May be one of:
@@ -196,6 +218,13 @@ go_path = rule(
                 are copied into the tree.</li>
                 <li><code>"link"</code>: Source files are symlinked into the tree. All of the symlink
                 files are provided as separate output files.</li>
+                <li><code>"module"</code>: Like <code>"copy"</code>, but packages are laid out by
+                import path without a <code>src/</code> directory, and each module root gets a
+                synthesized <code>go.mod</code> file. Module roots are the longest common import
+                path prefixes of packages from the same repository. Each <code>go.mod</code>
+                replaces the other modules with their directories, and a <code>go.work</code>
+                file at the top uses all of them, so the output can be opened in an editor and
+                built with <code>go build</code>. <code>include_pkg</code> is ignored.</li>
             </ul>
 
             ***Note:*** In <code>"copy"</code> mode, when a <code>GoPath</code> is consumed as a set of input
@@ -242,6 +271,43 @@ go_path = rule(
     """,
 )
 
+def _module_roots(module_groups):
+    """Returns a sorted list of module root import paths.
+
+    Each group of import paths becomes a module rooted at their longest
+    common prefix.
+    """
+    roots = {}
+    for importpaths in module_groups.values():
+        roots[_common_path_prefix(importpaths)] = None
+    return sorted(roots.keys())
+
+# Hosts whose module roots are always the first three path elements.
+_THREE_ELEMENT_HOSTS = ("bitbucket.org", "github.com", "gitlab.com", "golang.org")
+
+def _vendored_module_root(importpath):
+    """Returns the prefix of importpath that identifies its vendored module.
+
+    For well-known hosts, this is the module root. Otherwise, it's the first
+    path element, and packages are grouped at their longest common prefix.
+    """
+    parts = importpath.split("/")
+    if parts[0] in _THREE_ELEMENT_HOSTS:
+        return "/".join(parts[:3])
+    return parts[0]
+
+def _common_path_prefix(importpaths):
+    prefix = importpaths[0].split("/")
+    for importpath in importpaths[1:]:
+        parts = importpath.split("/")
+        n = 0
+        for i in range(min(len(prefix), len(parts))):
+            if prefix[i] != parts[i]:
+                break
+            n = i + 1
+        prefix = prefix[:n]
+    return "/".join(prefix)
+
 def _merge_pkg(x, y):
     x_srcs = {f.path: None for f in x.srcs}
     x_data = {f.path: None for f in x.data}
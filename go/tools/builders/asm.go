@@ -67,7 +67,7 @@ func asm(args []string) error {
 // by the compiler. This is only needed in go1.12+ when there is at least one
 // .s file. If the symabis file is not needed, no file will be generated,
 // and "", nil will be returned.
-func buildSymabisFile(goenv *env, sFiles, hFiles []fileInfo, asmhdr string) (string, error) {
+func buildSymabisFile(goenv *env, sFiles, hFiles []fileInfo, asmFlags []string, asmhdr string) (string, error) {
 	if len(sFiles) == 0 {
 		return "", nil
 	}
@@ -128,6 +128,7 @@ func buildSymabisFile(goenv *env, sFiles, hFiles []fileInfo, asmhdr string) (str
 	}
 	// TODO(#1894): define GOOS_goos, GOARCH_goarch, both here and in the
 	// GoAsm action.
+	asmargs = append(asmargs, asmFlags...)
 	asmargs = append(asmargs, "-gensymabis", "-o", symabisName, "--")
 	for _, sFile := range sFiles {
 		asmargs = append(asmargs, sFile.filename)
@@ -61,6 +61,8 @@ func main() {
 		action = stdlib
 	case "stdliblist":
 		action = stdliblist
+	case "verify":
+		action = verify
 	default:
 		log.Fatalf("unknown action: %s", verb)
 	}
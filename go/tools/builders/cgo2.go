@@ -29,7 +29,7 @@ import (
 )
 
 // cgo2 processes a set of mixed source files with cgo.
-func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs []string, packagePath, packageName string, cc string, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags []string, cgoExportHPath string) (srcDir string, allGoSrcs, cObjs []string, err error) {
+func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs, dynimportObjs []string, packagePath, packageName string, cc string, cgoFlags, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags []string, cgoExportHPath string) (srcDir string, allGoSrcs, cObjs []string, err error) {
 	// Report an error if the C/C++ toolchain wasn't configured.
 	if cc == "" {
 		err := cgoError(cgoSrcs[:])
@@ -126,6 +126,7 @@ func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSr
 	if packagePath != "" {
 		args = append(args, "-importpath", packagePath)
 	}
+	args = append(args, cgoFlags...)
 	args = append(args, "--")
 	args = append(args, cppFlags...)
 	args = append(args, hdrIncludes...)
@@ -179,6 +180,7 @@ func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSr
 	// Link cgo binary and use the symbols to generate _cgo_import.go.
 	mainBin := filepath.Join(workDir, "_cgo_.o") // .o is a lie; it's an executable
 	args = append([]string{cc, "-o", mainBin, mainObj}, cObjs...)
+	args = append(args, dynimportObjs...)
 	args = append(args, combinedLdFlags...)
 	if err := goenv.runCommand(args); err != nil {
 		return "", nil, nil, err
@@ -186,6 +188,9 @@ func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSr
 
 	cgoImportsGo := filepath.Join(workDir, "_cgo_imports.go")
 	args = goenv.goTool("cgo", "-dynpackage", packageName, "-dynimport", mainBin, "-dynout", cgoImportsGo)
+	if packagePath == "runtime/cgo" {
+		args = append(args, "-dynlinker") // record path to dynamic linker
+	}
 	if err := goenv.runCommand(args); err != nil {
 		return "", nil, nil, err
 	}
@@ -121,7 +121,7 @@ func compile(args []string) error {
 	defer os.Remove(importcfgName)
 
 	// If there are assembly files, and this is go1.12+, generate symbol ABIs.
-	symabisName, err := buildSymabisFile(goenv, sFiles, hFiles, *asmhdr)
+	symabisName, err := buildSymabisFile(goenv, sFiles, hFiles, nil, *asmhdr)
 	if symabisName != "" {
 		defer os.Remove(symabisName)
 	}
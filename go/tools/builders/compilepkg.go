@@ -19,6 +19,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -40,20 +41,23 @@ func compilePkg(args []string) error {
 
 	fs := flag.NewFlagSet("GoCompilePkg", flag.ExitOnError)
 	goenv := envFlags(fs)
-	var unfilteredSrcs, coverSrcs, embedSrcs multiFlag
+	var unfilteredSrcs, coverSrcs, embedSrcs, dynimportObjs multiFlag
 	var deps archiveMultiFlag
 	var importPath, packagePath, nogoPath, packageListPath, coverMode string
-	var outPath, outFactsPath, cgoExportHPath string
-	var testFilter string
-	var gcFlags, asmFlags, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags quoteMultiFlag
+	var outPath, outFactsPath, cgoExportHPath, cgoSrcsDir, embedcfgOutPath string
+	var testFilter, packVerify string
+	var cgoAsm bool
+	var gcFlags, asmFlags, cgoFlags, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags quoteMultiFlag
 	fs.Var(&unfilteredSrcs, "src", ".go, .c, .cc, .m, .mm, .s, or .S file to be filtered and compiled")
 	fs.Var(&coverSrcs, "cover", ".go file that should be instrumented for coverage (must also be a -src)")
 	fs.Var(&embedSrcs, "embedsrc", "file that may be compiled into the package with a //go:embed directive")
+	fs.Var(&dynimportObjs, "dynimportobj", "object file (like a .syso file from a dependency) linked into the cgo binary used to resolve dynamic imports")
 	fs.Var(&deps, "arc", "Import path, package path, and file name of a direct dependency, separated by '='")
 	fs.StringVar(&importPath, "importpath", "", "The import path of the package being compiled. Not passed to the compiler, but may be displayed in debug data.")
 	fs.StringVar(&packagePath, "p", "", "The package path (importmap) of the package being compiled")
 	fs.Var(&gcFlags, "gcflags", "Go compiler flags")
 	fs.Var(&asmFlags, "asmflags", "Go assembler flags")
+	fs.Var(&cgoFlags, "cgoflags", "Go cgo tool flags")
 	fs.Var(&cppFlags, "cppflags", "C preprocessor flags")
 	fs.Var(&cFlags, "cflags", "C compiler flags")
 	fs.Var(&cxxFlags, "cxxflags", "C++ compiler flags")
@@ -66,7 +70,11 @@ func compilePkg(args []string) error {
 	fs.StringVar(&outPath, "o", "", "The output archive file to write compiled code")
 	fs.StringVar(&outFactsPath, "x", "", "The output archive file to write export data and nogo facts")
 	fs.StringVar(&cgoExportHPath, "cgoexport", "", "The _cgo_exports.h file to write")
+	fs.StringVar(&cgoSrcsDir, "cgosrcs", "", "The directory to write the Go files generated by cgo to, for editors")
+	fs.StringVar(&embedcfgOutPath, "embedcfg", "", "The file to write the resolved //go:embed patterns to, for editors")
 	fs.StringVar(&testFilter, "testfilter", "off", "Controls test package filtering")
+	fs.StringVar(&packVerify, "pack_verify", "off", "Whether to check the output archive is reproducible: off, warn or error")
+	fs.BoolVar(&cgoAsm, "cgoasm", false, "Whether .S files in cgo packages are assembled by the C compiler, like the go command does for the standard library")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -129,10 +137,13 @@ func compilePkg(args []string) error {
 		coverMode,
 		coverSrcs,
 		embedSrcs,
+		dynimportObjs,
 		cgoEnabled,
+		cgoAsm,
 		cc,
 		gcFlags,
 		asmFlags,
+		cgoFlags,
 		cppFlags,
 		cFlags,
 		cxxFlags,
@@ -143,7 +154,10 @@ func compilePkg(args []string) error {
 		packageListPath,
 		outPath,
 		outFactsPath,
-		cgoExportHPath)
+		cgoExportHPath,
+		cgoSrcsDir,
+		embedcfgOutPath,
+		packVerify)
 }
 
 func compileArchive(
@@ -155,10 +169,13 @@ func compileArchive(
 	coverMode string,
 	coverSrcs []string,
 	embedSrcs []string,
+	dynimportObjs []string,
 	cgoEnabled bool,
+	cgoAsm bool,
 	cc string,
 	gcFlags []string,
 	asmFlags []string,
+	cgoFlags []string,
 	cppFlags []string,
 	cFlags []string,
 	cxxFlags []string,
@@ -169,7 +186,10 @@ func compileArchive(
 	packageListPath string,
 	outPath string,
 	outXPath string,
-	cgoExportHPath string) error {
+	cgoExportHPath string,
+	cgoSrcsDir string,
+	embedcfgOutPath string,
+	packVerify string) error {
 
 	workDir, cleanup, err := goenv.workDir()
 	if err != nil {
@@ -215,16 +235,30 @@ func compileArchive(
 	for i, src := range srcs.objcxxSrcs {
 		objcxxSrcs[i] = src.filename
 	}
-	sSrcs := make([]string, len(srcs.sSrcs))
-	for i, src := range srcs.sSrcs {
-		sSrcs[i] = src.filename
-	}
 	hSrcs := make([]string, len(srcs.hSrcs))
 	for i, src := range srcs.hSrcs {
 		hSrcs[i] = src.filename
 	}
 	haveCgo := len(cgoSrcs)+len(cSrcs)+len(cxxSrcs)+len(objcSrcs)+len(objcxxSrcs) > 0
 
+	// In standard library packages that use cgo, .S files contain GNU
+	// assembly that must be preprocessed and assembled by the C compiler,
+	// like the go command does. Go assembly files always use the lower case
+	// .s extension. Other packages keep assembling .S files with the Go
+	// assembler.
+	var sSrcs []string
+	if cgoAsm && cgoEnabled && haveCgo {
+		var goAsmSrcs []fileInfo
+		for _, src := range srcs.sSrcs {
+			if filepath.Ext(src.filename) == ".S" {
+				sSrcs = append(sSrcs, src.filename)
+			} else {
+				goAsmSrcs = append(goAsmSrcs, src)
+			}
+		}
+		srcs.sSrcs = goAsmSrcs
+	}
+
 	// Instrument source files for coverage.
 	if coverMode != "" {
 		shouldCover := make(map[string]bool)
@@ -271,12 +305,18 @@ func compileArchive(
 	if cgoEnabled && haveCgo {
 		// TODO(#2006): Compile .s and .S files with cgo2, not the Go assembler.
 		// If cgo is not enabled or we don't have other cgo sources, don't
-		// compile .S files.
+		// compile .S files. Only the standard library opts in with -cgoasm.
 		var srcDir string
-		srcDir, goSrcs, objFiles, err = cgo2(goenv, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, nil, hSrcs, packagePath, packageName, cc, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags, cgoExportHPath)
+		nGoSrcs := len(goSrcs)
+		srcDir, goSrcs, objFiles, err = cgo2(goenv, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs, dynimportObjs, packagePath, packageName, cc, cgoFlags, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags, cgoExportHPath)
 		if err != nil {
 			return err
 		}
+		if cgoSrcsDir != "" {
+			if err := writeCgoSrcs(cgoSrcsDir, goSrcs[nGoSrcs:], cgoSrcs); err != nil {
+				return err
+			}
+		}
 
 		gcFlags = append(gcFlags, createTrimPath(gcFlags, srcDir))
 	} else {
@@ -285,6 +325,11 @@ func compileArchive(
 				return err
 			}
 		}
+		if cgoSrcsDir != "" {
+			if err := writeCgoSrcs(cgoSrcsDir, nil, nil); err != nil {
+				return err
+			}
+		}
 		gcFlags = append(gcFlags, createTrimPath(gcFlags, "."))
 	}
 
@@ -355,6 +400,11 @@ func compileArchive(
 	if embedcfgPath != "" {
 		defer os.Remove(embedcfgPath)
 	}
+	if embedcfgOutPath != "" {
+		if err := writeEmbedcfgOut(embedcfgOutPath, embedcfgPath); err != nil {
+			return err
+		}
+	}
 
 	// Run nogo concurrently.
 	var nogoChan chan error
@@ -378,7 +428,7 @@ func compileArchive(
 	if len(srcs.sSrcs) > 0 {
 		asmHdrPath = filepath.Join(workDir, "go_asm.h")
 	}
-	symabisPath, err := buildSymabisFile(goenv, srcs.sSrcs, srcs.hSrcs, asmHdrPath)
+	symabisPath, err := buildSymabisFile(goenv, srcs.sSrcs, srcs.hSrcs, asmFlags, asmHdrPath)
 	if symabisPath != "" {
 		defer os.Remove(symabisPath)
 	}
@@ -424,6 +474,9 @@ func compileArchive(
 			return err
 		}
 	}
+	if err := verifyPackedArchive(outPath, packVerify, nil); err != nil {
+		return err
+	}
 
 	// Check results from nogo.
 	nogoStatus := nogoNotRun
@@ -512,10 +565,13 @@ func runNogo(ctx context.Context, workDir string, nogoPath string, srcs []string
 	return nil
 }
 
+// createTrimPath returns a -trimpath flag that removes path, keeping any
+// rewrites from a -trimpath flag already in gcFlags. The compiler separates
+// rewrites with semicolons.
 func createTrimPath(gcFlags []string, path string) string {
 	for _, flag := range gcFlags {
 		if strings.HasPrefix(flag, "-trimpath=") {
-			return flag + ":" + path
+			return flag + ";" + path
 		}
 	}
 
@@ -533,3 +589,114 @@ func sanitizePathForIdentifier(path string) string {
 		return '_'
 	}, path)
 }
+
+// writeCgoSrcs copies the Go files generated by cgo to dir, so that editors
+// can type check cgo packages. Only _cgo_gotypes.go and the .cgo1.go files
+// are copied, like the go command reports in CompiledGoFiles; the dynamic
+// imports in _cgo_imports.go only matter to the linker. cgo ran on copies
+// of cgoSrcs in a temporary directory, so //line directives are rewritten
+// to refer to cgoSrcs. A relative file in a //line directive is resolved
+// against the directory of the generated file, and the action may run in a
+// sandbox, so files are written like the package JSON files of the
+// gopackagesdriver aspect: relative to the workspace, the execution root or
+// the output base, after a placeholder that the driver replaces.
+func writeCgoSrcs(dir string, genGoSrcs, cgoSrcs []string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	origSrcs := make(map[string]string)
+	for _, src := range cgoSrcs {
+		rel, err := filepath.Rel(wd, src)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			// Instrumented copies of the sources live outside of the
+			// execution root.
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		prefix := "__BAZEL_WORKSPACE__"
+		if strings.HasPrefix(rel, "bazel-out/") {
+			prefix = "__BAZEL_EXECROOT__"
+		} else if strings.HasPrefix(rel, "external/") {
+			prefix = "__BAZEL_OUTPUT_BASE__"
+		}
+		origSrcs[filepath.Base(src)] = prefix + "/" + rel
+	}
+	for _, src := range genGoSrcs {
+		if filepath.Base(src) == "_cgo_imports.go" {
+			continue
+		}
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(string(data), "\n")
+		for i, line := range lines {
+			lines[i] = rewriteLineDirective(line, origSrcs)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(src)), []byte(strings.Join(lines, "\n")), 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteLineDirective replaces the file in a "//line file:line:col"
+// directive with the file in origSrcs with the same base name, if any.
+func rewriteLineDirective(line string, origSrcs map[string]string) string {
+	const prefix = "//line "
+	if !strings.HasPrefix(line, prefix) {
+		return line
+	}
+	pos := line[len(prefix):]
+	end := len(pos)
+	for n := 0; n < 2; n++ {
+		end = strings.LastIndex(pos[:end], ":")
+		if end < 0 {
+			return line
+		}
+	}
+	orig, ok := origSrcs[filepath.Base(pos[:end])]
+	if !ok {
+		return line
+	}
+	return prefix + orig + pos[end:]
+}
+
+// writeEmbedcfgOut writes the embedcfg file at embedcfgPath to outPath, so
+// that editors can report embedded files. Files are made relative to the
+// execution root, since actions may run in a sandbox. If embedcfgPath is
+// empty, because the package doesn't embed files, an empty configuration is
+// written.
+func writeEmbedcfgOut(outPath, embedcfgPath string) error {
+	var embedcfg struct {
+		Patterns map[string][]string
+		Files    map[string]string
+	}
+	if embedcfgPath != "" {
+		data, err := ioutil.ReadFile(embedcfgPath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &embedcfg); err != nil {
+			return err
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	for rel, file := range embedcfg.Files {
+		if relFile, err := filepath.Rel(wd, file); err == nil {
+			embedcfg.Files[rel] = filepath.ToSlash(relFile)
+		}
+	}
+	data, err := json.MarshalIndent(&embedcfg, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outPath, data, 0666)
+}
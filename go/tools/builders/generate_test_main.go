@@ -149,9 +149,24 @@ func testsInShard() []testing.InternalTest {
 	if err != nil || shardIndex < 0 {
 		return allTests
 	}
+	// Tell Bazel that sharding is supported.
+	if statusFile := os.Getenv("TEST_SHARD_STATUS_FILE"); statusFile != "" {
+		if f, err := os.Create(statusFile); err == nil {
+			f.Close()
+		}
+	}
+	names := make([]string, len(allTests))
+	for i, t := range allTests {
+		names[i] = t.Name
+	}
+	shards := bzltestutil.AssignShards(names, totalShards)
 	tests := []testing.InternalTest{}
 	for i, t := range allTests {
-		if i % totalShards == shardIndex {
+		shard := i % totalShards
+		if shards != nil {
+			shard = shards[i]
+		}
+		if shard == shardIndex {
 			tests = append(tests, t)
 		}
 	}
@@ -161,7 +176,10 @@ func testsInShard() []testing.InternalTest {
 func main() {
 	if bzltestutil.ShouldWrap() {
 		err := bzltestutil.Wrap("{{.Pkgname}}")
-		if xerr, ok := err.(*exec.ExitError); ok {
+		if err == bzltestutil.ErrTestTimedOut {
+			log.Print(err)
+			os.Exit(bzltestutil.TestWrapperTimeoutExit)
+		} else if xerr, ok := err.(*exec.ExitError); ok {
 			os.Exit(xerr.ExitCode())
 		} else if err != nil {
 			log.Print(err)
@@ -178,13 +196,29 @@ func main() {
   {{end}}
 
 	if filter := os.Getenv("TESTBRIDGE_TEST_ONLY"); filter != "" {
-		flag.Lookup("test.run").Value.Set(filter)
+		run, skip := bzltestutil.ParseTestFilter(filter)
+		if run != "" {
+			flag.Lookup("test.run").Value.Set(run)
+		}
+		if skip != "" {
+			{{if .Version "go1.20"}}
+			flag.Lookup("test.skip").Value.Set(skip)
+			{{else}}
+			log.Printf("excluding tests from --test_filter requires Go 1.20, running %q anyway", skip)
+			{{end}}
+		}
 	}
 
 	if failfast := os.Getenv("TESTBRIDGE_TEST_RUNNER_FAIL_FAST"); failfast != "" {
 		flag.Lookup("test.failfast").Value.Set("true")
 	}
 
+	{{if and (.Version "go1.18") .FuzzTargets}}
+	// go test sets the directory fuzzing caches interesting inputs in, and
+	// the test binary doesn't run fuzz targets without it.
+	flag.Lookup("test.fuzzcachedir").Value.Set(bzltestutil.FuzzCacheDir("{{.Pkgname}}"))
+	{{end}}
+
 	{{if ne .CoverMode ""}}
 	if len(coverdata.Counters) > 0 {
 		testing.RegisterCover(testing.Cover{
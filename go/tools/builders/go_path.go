@@ -24,7 +24,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
 )
 
 type mode int
@@ -34,6 +39,7 @@ const (
 	archiveMode
 	copyMode
 	linkMode
+	moduleMode
 )
 
 func modeFromString(s string) (mode, error) {
@@ -44,6 +50,8 @@ func modeFromString(s string) (mode, error) {
 		return copyMode, nil
 	case "link":
 		return linkMode, nil
+	case "module":
+		return moduleMode, nil
 	default:
 		return invalidMode, fmt.Errorf("invalid mode: %s", s)
 	}
@@ -66,7 +74,9 @@ func run(args []string) error {
 	flags := flag.NewFlagSet("go_path", flag.ContinueOnError)
 	flags.StringVar(&manifest, "manifest", "", "name of json file listing files to include")
 	flags.StringVar(&out, "out", "", "output file or directory")
-	modeFlag := flags.String("mode", "", "copy, link, or archive")
+	modeFlag := flags.String("mode", "", "copy, link, archive, or module")
+	var modules multiFlag
+	flags.Var(&modules, "module", "import path of a module root, in module mode (may be repeated)")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -96,6 +106,8 @@ func run(args []string) error {
 		err = copyPath(out, entries)
 	case linkMode:
 		err = linkPath(out, entries)
+	case moduleMode:
+		err = modulePath(out, entries, modules)
 	}
 	return err
 }
@@ -201,3 +213,105 @@ func linkPath(out string, manifest []manifestEntry) error {
 	}
 	return nil
 }
+
+// modulePath copies files into out like copyPath, then writes a go.mod file
+// in the directory of each module root and a go.work file in out that uses
+// all of them. Files in the manifest are expected to be laid out by import
+// path, without a src/ prefix.
+//
+// Each go.mod requires every other module at v0.0.0 and replaces it with its
+// directory, so packages can be built with or without the go.work file.
+func modulePath(out string, manifest []manifestEntry, modules []string) error {
+	if err := copyPath(out, manifest); err != nil {
+		return err
+	}
+
+	goVersion := goLanguageVersion()
+	modules = append([]string(nil), modules...)
+	sort.Strings(modules)
+	for _, mod := range modules {
+		if err := os.MkdirAll(filepath.Join(out, filepath.FromSlash(mod)), 0777); err != nil {
+			return err
+		}
+		goMod := formatGoMod(mod, modules, goVersion)
+		goModPath := filepath.Join(out, filepath.FromSlash(mod), "go.mod")
+		if err := ioutil.WriteFile(goModPath, []byte(goMod), 0666); err != nil {
+			return err
+		}
+	}
+	goWork := formatGoWork(modules, goVersion)
+	return ioutil.WriteFile(filepath.Join(out, "go.work"), []byte(goWork), 0666)
+}
+
+func formatGoMod(mod string, modules []string, goVersion string) string {
+	var requires, replaces []string
+	for _, other := range modules {
+		if other == mod {
+			continue
+		}
+		rel := relModulePath(mod, other)
+		requires = append(requires, fmt.Sprintf("\t%s v0.0.0\n", other))
+		replaces = append(replaces, fmt.Sprintf("\t%s => %s\n", other, rel))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "module %s\n\ngo %s\n", mod, goVersion)
+	if len(requires) > 0 {
+		fmt.Fprintf(&b, "\nrequire (\n%s)\n", strings.Join(requires, ""))
+		fmt.Fprintf(&b, "\nreplace (\n%s)\n", strings.Join(replaces, ""))
+	}
+	return b.String()
+}
+
+func formatGoWork(modules []string, goVersion string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "go %s\n\nuse (\n", goVersion)
+	for _, mod := range modules {
+		fmt.Fprintf(&b, "\t./%s\n", mod)
+	}
+	b.WriteString(")\n")
+	return b.String()
+}
+
+// relModulePath returns the slash-separated path from the directory of
+// module from to the directory of module to. Module directories are named
+// after their import paths. The result always starts with "./" or "../", so
+// the go command treats it as a directory rather than a module path.
+func relModulePath(from, to string) string {
+	fromParts := strings.Split(from, "/")
+	toParts := strings.Split(to, "/")
+	i := 0
+	for i < len(fromParts) && i < len(toParts) && fromParts[i] == toParts[i] {
+		i++
+	}
+	var rel []string
+	for range fromParts[i:] {
+		rel = append(rel, "..")
+	}
+	rel = append(rel, toParts[i:]...)
+	if len(rel) == 0 || rel[0] != ".." {
+		return "./" + path.Join(rel...)
+	}
+	return path.Join(rel...)
+}
+
+var goVersionRE = regexp.MustCompile(`^go(1\.\d+)`)
+
+// goLanguageVersion returns the language version to write in go.mod and
+// go.work files. The builder is compiled with the same SDK that builds the
+// packages in the go_path, so its version is the one those packages target.
+// go.work files are only understood by Go 1.18 and later.
+func goLanguageVersion() string {
+	const minVersion = "1.18"
+	m := goVersionRE.FindStringSubmatch(runtime.Version())
+	if m == nil {
+		return minVersion
+	}
+	var minor, minMinor int
+	fmt.Sscanf(m[1], "1.%d", &minor)
+	fmt.Sscanf(minVersion, "1.%d", &minMinor)
+	if minor < minMinor {
+		return minVersion
+	}
+	return m[1]
+}
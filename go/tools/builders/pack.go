@@ -17,6 +17,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
@@ -33,10 +34,11 @@ import (
 // go tool pack. It is invoked by the Go rules as an action.
 //
 // pack can also append .o files contained in a static library passed in
-// with the -arc option. That archive may be in BSD or SysV / GNU format.
-// pack has a primitive parser for these formats, since cmd/pack can't
-// handle them, and ar may not be available (cpp.ar_executable is libtool
-// on darwin).
+// with the -arc option. That archive may be in BSD or SysV / GNU format,
+// with long names, or a GNU thin archive that refers to objects stored
+// next to it. pack has a primitive parser for these formats, since cmd/pack
+// can't handle them, and ar may not be available (cpp.ar_executable is
+// libtool on darwin).
 func pack(args []string) error {
 	args, err := expandParamsFiles(args)
 	if err != nil {
@@ -50,6 +52,7 @@ func pack(args []string) error {
 	flags.Var(&objects, "obj", "Object to append (may be repeated)")
 	archives := multiFlag{}
 	flags.Var(&archives, "arc", "Archives to append")
+	verifyMode := flags.String("verify", "off", "Whether to check the output archive is reproducible: off, warn or error")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -67,7 +70,14 @@ func pack(args []string) error {
 	}
 	defer os.RemoveAll(dir)
 
-	names := map[string]struct{}{}
+	// names maps the names of members written to the output archive to the
+	// names they had in their original archives. cmd/pack writes names in the
+	// common format, which is limited to 16 characters, and cmd/link doesn't
+	// read long name tables, so members from -arc archives may be renamed.
+	names := map[string]string{}
+	for _, obj := range objects {
+		names[filepath.Base(obj)] = obj
+	}
 	for _, archive := range archives {
 		archiveObjects, err := extractFiles(archive, dir, names)
 		if err != nil {
@@ -76,7 +86,38 @@ func pack(args []string) error {
 		objects = append(objects, archiveObjects...)
 	}
 
-	return appendFiles(goenv, abs(*outArchive), objects)
+	if err := appendFiles(goenv, abs(*outArchive), objects); err != nil {
+		return err
+	}
+	return verifyPackedArchive(*outArchive, *verifyMode, names)
+}
+
+// verifyPackedArchive runs the checks from the verify verb on an archive
+// produced by pack. In "warn" mode, problems are printed but don't fail
+// the action. names maps renamed members to their original names, so
+// problems can be reported against the object the user knows about.
+func verifyPackedArchive(archive, mode string, names map[string]string) error {
+	switch mode {
+	case "off":
+		return nil
+	case "warn", "error":
+	default:
+		return fmt.Errorf("invalid -verify mode %q; want off, warn or error", mode)
+	}
+	issues, err := verifyArchive(archive, defaultVerifyRoots())
+	if err != nil || len(issues) == 0 {
+		return err
+	}
+	for i := range issues {
+		if orig, ok := names[issues[i].member]; ok && orig != issues[i].member {
+			issues[i].member = fmt.Sprintf("%s (%s)", issues[i].member, orig)
+		}
+	}
+	if mode == "warn" {
+		fmt.Fprint(os.Stderr, formatArchiveIssues(issues))
+		return nil
+	}
+	return fmt.Errorf("archive is not reproducible:\n%s", formatArchiveIssues(issues))
 }
 
 func copyFile(inPath, outPath string) error {
@@ -115,6 +156,10 @@ const (
 	// "go tool pack" on all platforms.
 	arHeader = "!<arch>\n"
 
+	// thinArHeader appears at the beginning of GNU thin archives, created
+	// with "ar T" or "ar --thin".
+	thinArHeader = "!<thin>\n"
+
 	// entryLength is the size in bytes of the metadata preceding each file
 	// in an archive.
 	entryLength = 60
@@ -132,9 +177,16 @@ type bufioReaderWithCloser struct {
 	// bufio.Reader is needed to skip bytes in archives
 	*bufio.Reader
 	io.Closer
+
+	// thin is true for GNU thin archives. Their members' data is not stored
+	// in the archive; member names are paths relative to the archive.
+	thin bool
 }
 
-func extractFiles(archive, dir string, names map[string]struct{}) (files []string, err error) {
+// extractFiles writes the object files in archive to dir and returns their
+// paths. Files are renamed with simpleName; names records the original
+// member names.
+func extractFiles(archive, dir string, names map[string]string) (files []string, err error) {
 	rc, err := openArchive(archive)
 	if err != nil {
 		return nil, err
@@ -151,21 +203,40 @@ func extractFiles(archive, dir string, names map[string]struct{}) (files []strin
 		if err != nil {
 			return nil, err
 		}
+		if rc.thin {
+			if !isObjectFile(name) {
+				continue
+			}
+			memberPath := filepath.FromSlash(name)
+			if !filepath.IsAbs(memberPath) {
+				memberPath = filepath.Join(filepath.Dir(archive), memberPath)
+			}
+			outName, err := simpleName(name, names)
+			if err != nil {
+				return nil, err
+			}
+			outPath := filepath.Join(dir, outName)
+			if err := copyOrLinkFile(memberPath, outPath); err != nil {
+				return nil, fmt.Errorf("%s: member %s: %v", archive, name, err)
+			}
+			files = append(files, outPath)
+			continue
+		}
 		if !isObjectFile(name) {
 			if err := skipFile(bufReader, size); err != nil {
 				return nil, err
 			}
 			continue
 		}
-		name, err = simpleName(name, names)
+		outName, err := simpleName(name, names)
 		if err != nil {
 			return nil, err
 		}
-		name = filepath.Join(dir, name)
-		if err := extractFile(bufReader, name, size); err != nil {
+		outPath := filepath.Join(dir, outName)
+		if err := extractFile(bufReader, outPath, size); err != nil {
 			return nil, err
 		}
-		files = append(files, name)
+		files = append(files, outPath)
 	}
 }
 
@@ -176,11 +247,11 @@ func openArchive(archive string) (bufioReaderWithCloser, error) {
 	}
 	r := bufio.NewReader(f)
 	header := make([]byte, len(arHeader))
-	if _, err := io.ReadFull(r, header); err != nil || string(header) != arHeader {
+	if _, err := io.ReadFull(r, header); err != nil || (string(header) != arHeader && string(header) != thinArHeader) {
 		f.Close()
 		return bufioReaderWithCloser{}, fmt.Errorf("%s: bad header", archive)
 	}
-	return bufioReaderWithCloser{r, f}, nil
+	return bufioReaderWithCloser{Reader: r, Closer: f, thin: string(header) == thinArHeader}, nil
 }
 
 // readMetadata reads the relevant fields of an entry. Before calling,
@@ -190,19 +261,30 @@ func openArchive(archive string) (bufioReaderWithCloser, error) {
 //
 // Both BSD and GNU / SysV naming conventions are supported.
 func readMetadata(r *bufio.Reader, nameData *[]byte) (name string, size int64, err error) {
+	_, name, size, err = readEntry(r, nameData)
+	return name, size, err
+}
+
+// readEntry is like readMetadata, but it also returns the raw header of the
+// entry, so callers can inspect the fields readMetadata ignores.
+func readEntry(r *bufio.Reader, nameData *[]byte) (hdr *header, name string, size int64, err error) {
 retry:
 	// Each file is preceded by a 60-byte header that contains its metadata.
 	// We only care about two fields, name and size. Other fields (mtime,
 	// owner, group, mode) are ignored because they don't affect compilation.
 	var entry [entryLength]byte
 	if _, err := io.ReadFull(r, entry[:]); err != nil {
-		return "", 0, err
+		return nil, "", 0, err
+	}
+	hdr = &header{}
+	if err := binary.Read(bytes.NewReader(entry[:]), binary.BigEndian, hdr); err != nil {
+		return nil, "", 0, err
 	}
 
 	sizeField := strings.TrimSpace(string(entry[48:58]))
 	size, err = strconv.ParseInt(sizeField, 10, 64)
 	if err != nil {
-		return "", 0, err
+		return nil, "", 0, err
 	}
 
 	nameField := strings.TrimRight(string(entry[:16]), " ")
@@ -214,11 +296,11 @@ retry:
 		nameField = nameField[len("#1/"):]
 		nameLen, err := strconv.ParseInt(nameField, 10, 64)
 		if err != nil {
-			return "", 0, err
+			return nil, "", 0, err
 		}
 		nameBuf := make([]byte, nameLen)
 		if _, err := io.ReadFull(r, nameBuf); err != nil {
-			return "", 0, err
+			return nil, "", 0, err
 		}
 		name = strings.TrimRight(string(nameBuf), "\x00")
 		size -= nameLen
@@ -229,41 +311,46 @@ retry:
 		// the next entry.
 		*nameData = make([]byte, size)
 		if _, err := io.ReadFull(r, *nameData); err != nil {
-			return "", 0, err
+			return nil, "", 0, err
 		}
 		if size%2 != 0 {
 			// Files are aligned at 2-byte offsets. Discard the padding byte if the
 			// size was odd.
 			if _, err := r.ReadByte(); err != nil {
-				return "", 0, err
+				return nil, "", 0, err
 			}
 		}
 		goto retry
 
-	case nameField == "/":
-		// GNU / SysV-style symbol lookup table. Skip.
+	case nameField == "/" || nameField == "/SYM64/":
+		// GNU / SysV-style symbol lookup table. Skip. /SYM64/ is used instead
+		// of / when the archive has offsets that don't fit in 32 bits.
 		if err := skipFile(r, size); err != nil {
-			return "", 0, err
+			return nil, "", 0, err
 		}
 		goto retry
 
 	case strings.HasPrefix(nameField, "/"):
 		// GNU / SysV-style long file name. The number that follows the slash is
 		// an offset into the name data that should have been read earlier.
-		// The file name ends with a slash.
+		// The file name ends with a slash and a newline. Names of members of
+		// thin archives are paths, so they may contain other slashes.
 		nameField = nameField[1:]
 		nameOffset, err := strconv.Atoi(nameField)
 		if err != nil {
-			return "", 0, err
+			return nil, "", 0, err
 		}
 		if nameData == nil || nameOffset < 0 || nameOffset >= len(*nameData) {
-			return "", 0, fmt.Errorf("invalid name length: %d", nameOffset)
+			return nil, "", 0, fmt.Errorf("invalid name length: %d", nameOffset)
 		}
-		i := bytes.IndexByte((*nameData)[nameOffset:], '/')
-		if i < 0 {
-			return "", 0, errors.New("file name does not end with '/'")
+		nameEntry := (*nameData)[nameOffset:]
+		if i := bytes.IndexByte(nameEntry, '\n'); i >= 0 {
+			nameEntry = nameEntry[:i]
 		}
-		name = string((*nameData)[nameOffset : nameOffset+i])
+		if !bytes.HasSuffix(nameEntry, []byte("/")) {
+			return nil, "", 0, errors.New("file name does not end with '/'")
+		}
+		name = string(nameEntry[:len(nameEntry)-1])
 
 	case strings.HasSuffix(nameField, "/"):
 		// GNU / SysV-style short file name.
@@ -274,7 +361,7 @@ retry:
 		name = nameField
 	}
 
-	return name, size, err
+	return hdr, name, size, err
 }
 
 // extractFile reads size bytes from r and writes them to a new file, name.
@@ -315,10 +402,16 @@ func isObjectFile(name string) bool {
 // simpleName returns a file name which is at most 15 characters
 // and doesn't conflict with other names. If it is not possible to choose
 // such a name, simpleName will truncate the given name to 15 characters.
-// The original file extension will be preserved.
-func simpleName(name string, names map[string]struct{}) (string, error) {
+// The original file extension will be preserved. The chosen name is added
+// to names, mapped to the original name.
+func simpleName(name string, names map[string]string) (string, error) {
+	orig := name
+	// Members of thin archives are named by their paths.
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
 	if _, ok := names[name]; !ok && len(name) < 16 {
-		names[name] = struct{}{}
+		names[name] = orig
 		return name, nil
 	}
 	var stem, ext string
@@ -339,7 +432,7 @@ func simpleName(name string, names map[string]struct{}) (string, error) {
 		}
 		candidate := stem[:stemLen] + ns + ext
 		if _, ok := names[candidate]; !ok {
-			names[candidate] = struct{}{}
+			names[candidate] = orig
 			return candidate, nil
 		}
 	}
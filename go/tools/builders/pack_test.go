@@ -0,0 +1,191 @@
+// Copyright 2023 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type arEntry struct {
+	// nameField is written as is in the header.
+	nameField string
+	// data is the content of the entry. For members of thin archives, it is
+	// not written, but its length is recorded.
+	data string
+}
+
+// writeRawArchive writes an archive with the given magic string and
+// entries. The caller is responsible for name tables.
+func writeRawArchive(t *testing.T, path, magic string, entries []arEntry) {
+	var buf strings.Builder
+	buf.WriteString(magic)
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", e.nameField, 0, 0, 0, 0644, len(e.data))
+		isTable := e.nameField == "/" || e.nameField == "//"
+		if magic == thinArHeader && !isTable {
+			continue
+		}
+		buf.WriteString(e.data)
+		if len(e.data)%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte(buf.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractFiles(t *testing.T) {
+	const (
+		longA = "a_very_long_object_name.o"
+		longB = "a_very_long_object_name_too.o"
+	)
+	for _, test := range []struct {
+		desc    string
+		magic   string
+		entries []arEntry
+		// files are written next to the archive, for thin archives.
+		files     map[string]string
+		wantNames map[string]string
+		wantData  map[string]string
+	}{
+		{
+			desc:  "gnu",
+			magic: arHeader,
+			entries: []arEntry{
+				{nameField: "/", data: "symtab"},
+				{nameField: "//", data: longA + "/\n" + longB + "/\n"},
+				{nameField: "short.o/", data: "short"},
+				{nameField: "/0", data: "A"},
+				{nameField: fmt.Sprintf("/%d", len(longA)+2), data: "B"},
+			},
+			wantNames: map[string]string{
+				"short.o":         "short.o",
+				"a_very_long_0.o": longA,
+				"a_very_long_1.o": longB,
+			},
+			wantData: map[string]string{
+				"short.o":         "short",
+				"a_very_long_0.o": "A",
+				"a_very_long_1.o": "B",
+			},
+		},
+		{
+			desc:  "bsd",
+			magic: arHeader,
+			entries: []arEntry{
+				{nameField: "__.SYMDEF", data: "symtab"},
+				{nameField: fmt.Sprintf("#1/%d", len(longA)+3), data: longA + "\x00\x00\x00" + "A"},
+			},
+			wantNames: map[string]string{
+				"a_very_long_0.o": longA,
+			},
+			wantData: map[string]string{
+				"a_very_long_0.o": "A",
+			},
+		},
+		{
+			desc:  "thin",
+			magic: thinArHeader,
+			entries: []arEntry{
+				{nameField: "/", data: "symtab"},
+				{nameField: "//", data: "obj/" + longA + "/\nother/" + longA + "/\n"},
+				{nameField: "/0", data: "A"},
+				{nameField: fmt.Sprintf("/%d", len(longA)+6), data: "BB"},
+			},
+			files: map[string]string{
+				"obj/" + longA:   "A",
+				"other/" + longA: "BB",
+			},
+			wantNames: map[string]string{
+				"a_very_long_0.o": "obj/" + longA,
+				"a_very_long_1.o": "other/" + longA,
+			},
+			wantData: map[string]string{
+				"a_very_long_0.o": "A",
+				"a_very_long_1.o": "BB",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range test.files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			archive := filepath.Join(dir, "lib.a")
+			writeRawArchive(t, archive, test.magic, test.entries)
+
+			outDir := filepath.Join(dir, "out")
+			if err := os.Mkdir(outDir, 0777); err != nil {
+				t.Fatal(err)
+			}
+			names := map[string]string{}
+			files, err := extractFiles(archive, outDir, names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, test.wantNames) {
+				t.Errorf("got names %v; want %v", names, test.wantNames)
+			}
+			gotData := map[string]string{}
+			for _, f := range files {
+				data, err := ioutil.ReadFile(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotData[filepath.Base(f)] = string(data)
+			}
+			if !reflect.DeepEqual(gotData, test.wantData) {
+				t.Errorf("got files %v; want %v", gotData, test.wantData)
+			}
+		})
+	}
+}
+
+func TestSimpleNameCollisions(t *testing.T) {
+	names := map[string]string{"foo.o": "foo.o"}
+	for _, test := range []struct {
+		name, want string
+	}{
+		{name: "bar.o", want: "bar.o"},
+		{name: "foo.o", want: "foo0.o"},
+		{name: "dir/foo.o", want: "foo1.o"},
+		{name: "x.y.z.o", want: "x.y.z.o"},
+		{name: "this.is.a.long.name.o", want: "this_is_a_lo0.o"},
+	} {
+		got, err := simpleName(test.name, names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("simpleName(%q) = %q; want %q", test.name, got, test.want)
+		}
+		if names[got] != test.name {
+			t.Errorf("names[%q] = %q; want %q", got, names[got], test.name)
+		}
+	}
+}
@@ -15,24 +15,31 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"go/build"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"unicode"
 )
 
 // stdlib builds the standard library in the appropriate mode into a new goroot.
+// Each package is compiled separately with the compilepkg action, using the
+// package metadata reported by "go list". This all happens in the single
+// GoStdlib action, so packages aren't cached individually by Bazel yet.
 func stdlib(args []string) error {
 	// process the args
 	flags := flag.NewFlagSet("stdlib", flag.ExitOnError)
 	goenv := envFlags(flags)
 	out := flags.String("out", "", "Path to output go root")
-	race := flags.Bool("race", false, "Build in race mode")
-	shared := flags.Bool("shared", false, "Build in shared mode")
-	dynlink := flags.Bool("dynlink", false, "Build in dynlink mode")
+	var gcFlags, asmFlags quoteMultiFlag
+	flags.Var(&gcFlags, "gcflags", "Go compiler flags applied to every package")
+	flags.Var(&asmFlags, "asmflags", "Go assembler flags applied to every package")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -64,13 +71,13 @@ You may need to use the flags --cpu=x64_windows --compiler=mingw-gcc.`)
 	// Now switch to the newly created GOROOT
 	os.Setenv("GOROOT", output)
 
-	// Create a temporary cache directory. "go build" requires this starting
+	// Create a temporary cache directory. "go list" requires this starting
 	// in Go 1.12.
 	cachePath := filepath.Join(output, ".gocache")
 	os.Setenv("GOCACHE", cachePath)
 	defer os.RemoveAll(cachePath)
 
-	// Disable modules for the 'go install' command. Depending on the sandboxing
+	// Disable modules for the 'go list' command. Depending on the sandboxing
 	// mode, there may be a go.mod file in a parent directory which will turn
 	// modules on in "auto" mode.
 	os.Setenv("GO111MODULE", "off")
@@ -86,8 +93,6 @@ You may need to use the flags --cpu=x64_windows --compiler=mingw-gcc.`)
 	}
 	os.Setenv("PATH", strings.Join(absPaths, string(os.PathListSeparator)))
 
-	sandboxPath := abs(".")
-
 	// Strip path prefix from source files in debug information.
 	os.Setenv("CGO_CFLAGS", os.Getenv("CGO_CFLAGS")+" "+strings.Join(defaultCFlags(output), " "))
 	os.Setenv("CGO_LDFLAGS", os.Getenv("CGO_LDFLAGS")+" "+strings.Join(defaultLdFlags(), " "))
@@ -109,58 +114,288 @@ You may need to use the flags --cpu=x64_windows --compiler=mingw-gcc.`)
 	}
 	os.Setenv("CGO_LDFLAGS_ALLOW", b.String())
 
-	// Build the commands needed to build the std library in the right mode
-	// NOTE: the go command stamps compiled .a files with build ids, which are
-	// cryptographic sums derived from the inputs. This prevents us from
-	// creating reproducible builds because the build ids are hashed from
-	// CGO_CFLAGS, which frequently contains absolute paths. As a workaround,
-	// we strip the build ids, since they won't be used after this.
-	installArgs := goenv.goCmd("install", "-toolexec", abs(os.Args[0])+" filterbuildid")
-	if len(build.Default.BuildTags) > 0 {
-		installArgs = append(installArgs, "-tags", strings.Join(build.Default.BuildTags, ","))
+	// Modifying CGO flags to use only absolute path
+	// because go is having its own sandbox, all CGO flags must use absolute path
+	if err := absEnv(cgoEnvVars, cgoAbsEnvFlags); err != nil {
+		return fmt.Errorf("error modifying cgo environment to absolute path: %v", err)
+	}
+
+	// List the packages to build. "go list -deps" prints packages in
+	// dependency order, so each package appears after everything it imports.
+	// TODO(#1885): don't build runtime/cgo in pure mode.
+	pkgs, err := listStdlib(goenv, "-deps", "std", "runtime/cgo")
+	if err != nil {
+		return err
 	}
 
-	gcflags := []string{}
-	ldflags := []string{"-trimpath", sandboxPath}
-	asmflags := []string{"-trimpath", output}
-	if *race {
-		installArgs = append(installArgs, "-race")
+	gcflags := append([]string{"-trimpath=" + output + "=>GOROOT"}, gcFlags...)
+	asmflags := append(stdlibAsmDefines(), asmFlags...)
+	return compileStdlib(goenv, output, pkgs, gcflags, asmflags)
+}
+
+// stdlibArchive is the result of compiling one standard library package.
+// done is closed once err is set.
+type stdlibArchive struct {
+	done chan struct{}
+	err  error
+}
+
+// compileStdlib compiles each package in pkgs with a separate compilepkg
+// invocation and installs the archives into GOROOT/pkg/installsuffix below
+// output. Packages are compiled in parallel as soon as their imports are
+// ready. pkgs must be in dependency order, as printed by "go list -deps".
+func compileStdlib(goenv *env, output string, pkgs []*goListPackage, gcflags, asmflags []string) error {
+	workDir, cleanup, err := goenv.workDir()
+	if err != nil {
+		return err
 	}
-	if *shared {
-		gcflags = append(gcflags, "-shared")
-		ldflags = append(ldflags, "-shared")
-		asmflags = append(asmflags, "-shared")
+	defer cleanup()
+
+	// compilepkg checks imports against a list of standard packages. Imports
+	// of vendored packages are passed as explicit dependencies instead.
+	packageListPath := filepath.Join(workDir, "packages.txt")
+	packageList := &strings.Builder{}
+	for _, pkg := range pkgs {
+		fmt.Fprintln(packageList, pkg.ImportPath)
 	}
-	if *dynlink {
-		gcflags = append(gcflags, "-dynlink")
-		ldflags = append(ldflags, "-dynlink")
-		asmflags = append(asmflags, "-dynlink")
+	if err := ioutil.WriteFile(packageListPath, []byte(packageList.String()), 0666); err != nil {
+		return err
 	}
 
-	// Since Go 1.10, an all= prefix indicates the flags should apply to the package
-	// and its dependencies, rather than just the package itself. This was the
-	// default behavior before Go 1.10.
-	allSlug := ""
-	for _, t := range build.Default.ReleaseTags {
-		if t == "go1.10" {
-			allSlug = "all="
-			break
+	pkgDir := filepath.Join(output, "pkg", goenv.installSuffix)
+	pkgByPath := make(map[string]*goListPackage)
+	for _, pkg := range pkgs {
+		pkgByPath[pkg.ImportPath] = pkg
+	}
+	// The map of archives is filled before any package starts compiling, so
+	// that the goroutines below only read it.
+	archives := make(map[string]*stdlibArchive)
+	for _, pkg := range pkgs {
+		if pkg.ImportPath == "unsafe" || len(pkg.GoFiles)+len(pkg.CgoFiles) == 0 {
+			// unsafe is implemented by the compiler. Packages without Go files
+			// are excluded by build constraints in this configuration.
+			continue
 		}
+		archives[pkg.ImportPath] = &stdlibArchive{done: make(chan struct{})}
+	}
+	sem := make(chan struct{}, runtime.NumCPU())
+	for _, pkg := range pkgs {
+		arc, ok := archives[pkg.ImportPath]
+		if !ok {
+			continue
+		}
+		go func(pkg *goListPackage, arc *stdlibArchive) {
+			defer close(arc.done)
+			// Wait for all transitive dependencies, not just imports. Packages
+			// that use cgo also import runtime/cgo and syscall implicitly.
+			for _, imp := range pkg.Deps {
+				dep, ok := archives[imp]
+				if !ok {
+					continue
+				}
+				<-dep.done
+				if dep.err != nil {
+					arc.err = fmt.Errorf("%s: dependency %s failed to build", pkg.ImportPath, imp)
+					return
+				}
+			}
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			arc.err = compileStdlibPackage(goenv, pkgDir, workDir, packageListPath, pkg, pkgByPath, gcflags, asmflags)
+		}(pkg, arc)
 	}
-	installArgs = append(installArgs, "-gcflags="+allSlug+strings.Join(gcflags, " "))
-	installArgs = append(installArgs, "-ldflags="+allSlug+strings.Join(ldflags, " "))
-	installArgs = append(installArgs, "-asmflags="+allSlug+strings.Join(asmflags, " "))
 
-	// Modifying CGO flags to use only absolute path
-	// because go is having its own sandbox, all CGO flags must use absolute path
-	if err := absEnv(cgoEnvVars, cgoAbsEnvFlags); err != nil {
-		return fmt.Errorf("error modifying cgo environment to absolute path: %v", err)
+	var errs []string
+	for _, pkg := range pkgs {
+		arc, ok := archives[pkg.ImportPath]
+		if !ok {
+			continue
+		}
+		<-arc.done
+		if arc.err != nil {
+			errs = append(errs, arc.err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// compileStdlibPackage compiles a single standard library package by running
+// the compilepkg action of this builder as a subprocess. A subprocess is used
+// because compilepkg modifies the process environment and work directory.
+func compileStdlibPackage(goenv *env, pkgDir, workDir, packageListPath string, pkg *goListPackage, pkgByPath map[string]*goListPackage, gcflags, asmflags []string) error {
+	outPath := filepath.Join(pkgDir, filepath.FromSlash(pkg.ImportPath)+".a")
+	if err := os.MkdirAll(filepath.Dir(outPath), 0777); err != nil {
+		return err
+	}
+	outXPath := filepath.Join(workDir, "x", filepath.FromSlash(pkg.ImportPath)+".x")
+	if err := os.MkdirAll(filepath.Dir(outXPath), 0777); err != nil {
+		return err
+	}
+
+	args := []string{
+		"-sdk", goenv.sdk,
+		"-installsuffix", goenv.installSuffix,
+		"-importpath", pkg.ImportPath,
+		"-p", pkg.ImportPath,
+		"-package_list", packageListPath,
+		"-o", outPath,
+		"-x", outXPath,
+		"-cgoasm",
+	}
+	if len(build.Default.BuildTags) > 0 {
+		args = append(args, "-tags", strings.Join(build.Default.BuildTags, ","))
+	}
+	for _, files := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.CFiles, pkg.SFiles, pkg.HFiles} {
+		for _, f := range files {
+			args = append(args, "-src", filepath.Join(pkg.Dir, f))
+		}
+	}
+	for _, f := range pkg.EmbedFiles {
+		args = append(args, "-embedsrc", filepath.Join(pkg.Dir, f))
+	}
+	if len(pkg.CgoFiles) > 0 {
+		// Like the go command, resolve dynamic imports of cgo packages against
+		// .syso files from the package and its dependencies.
+		for _, dep := range append([]string{pkg.ImportPath}, pkg.Deps...) {
+			if depPkg, ok := pkgByPath[dep]; ok {
+				for _, f := range depPkg.SysoFiles {
+					args = append(args, "-dynimportobj", filepath.Join(depPkg.Dir, f))
+				}
+			}
+		}
+	}
+	for imp, dep := range pkg.ImportMap {
+		depPath := filepath.Join(pkgDir, filepath.FromSlash(dep)+".a")
+		args = append(args, "-arc", imp+"="+dep+"="+depPath)
+	}
+
+	pkgGcflags := append([]string{"-std"}, gcflags...)
+	pkgAsmflags := append([]string{}, asmflags...)
+	if releaseTagAtLeast("go1.19") {
+		pkgAsmflags = append(pkgAsmflags, "-p", pkg.ImportPath)
+	}
+	if releaseTagAtLeast("go1.23") {
+		// Allows assembly in the standard library to reference symbols in
+		// internal runtime packages.
+		pkgAsmflags = append(pkgAsmflags, "-std")
+	}
+	// Since Go 1.22, the compiler and assembler infer this from -p.
+	if isCompilingRuntime(pkg.ImportPath) && !releaseTagAtLeast("go1.22") {
+		pkgGcflags = append(pkgGcflags, "-+")
+		if releaseTagAtLeast("go1.16") {
+			pkgAsmflags = append(pkgAsmflags, "-compiling-runtime")
+		}
+	}
+	var cgoflags []string
+	if pkg.ImportPath == "runtime/cgo" {
+		cgoflags = append(cgoflags, "-import_runtime_cgo=false")
+	}
+	switch pkg.ImportPath {
+	case "runtime/race", "runtime/msan", "runtime/asan", "runtime/cgo":
+		cgoflags = append(cgoflags, "-import_syscall=false")
+	}
+	for _, flags := range []struct {
+		name   string
+		values []string
+	}{
+		{"-gcflags", pkgGcflags},
+		{"-asmflags", pkgAsmflags},
+		{"-cgoflags", cgoflags},
+		{"-cppflags", cgoEnvFlags("CGO_CPPFLAGS", pkg.CgoCPPFLAGS)},
+		{"-cflags", cgoEnvFlags("CGO_CFLAGS", pkg.CgoCFLAGS)},
+		{"-cxxflags", cgoEnvFlags("CGO_CXXFLAGS", pkg.CgoCXXFLAGS)},
+		{"-ldflags", cgoEnvFlags("CGO_LDFLAGS", pkg.CgoLDFLAGS)},
+	} {
+		for _, v := range flags.values {
+			args = append(args, flags.name, quoteFlag(v))
+		}
 	}
 
-	// TODO(#1885): don't install runtime/cgo in pure mode.
-	installArgs = append(installArgs, "std", "runtime/cgo")
-	if err := goenv.runCommand(installArgs); err != nil {
+	paramsPath := filepath.Join(workDir, "x", filepath.FromSlash(pkg.ImportPath)+".param")
+	if err := writeParamsFile(paramsPath, args); err != nil {
 		return err
 	}
+	if err := goenv.runCommand([]string{abs(os.Args[0]), "compilepkg", "-param=" + paramsPath}); err != nil {
+		return fmt.Errorf("%s: %v", pkg.ImportPath, err)
+	}
+
+	// Object files shipped with the standard library (for example, the race
+	// detector runtime) are packed into the archive as is.
+	if len(pkg.SysoFiles) > 0 {
+		sysoFiles := make([]string, len(pkg.SysoFiles))
+		for i, f := range pkg.SysoFiles {
+			sysoFiles[i] = filepath.Join(pkg.Dir, f)
+		}
+		if err := appendFiles(goenv, outPath, sysoFiles); err != nil {
+			return fmt.Errorf("%s: %v", pkg.ImportPath, err)
+		}
+	}
 	return nil
 }
+
+// cgoEnvFlags returns the flags in the named environment variable followed by
+// the flags from a package's #cgo directives, the same way the go command
+// combines them.
+func cgoEnvFlags(name string, pkgFlags []string) []string {
+	flags, _ := splitQuoted(os.Getenv(name))
+	return append(flags, pkgFlags...)
+}
+
+// isCompilingRuntime reports whether the compiler needs the -+ flag to compile
+// the given standard library package. This mirrors the logic in the go command
+// before Go 1.22.
+func isCompilingRuntime(importPath string) bool {
+	return importPath == "runtime" ||
+		strings.HasPrefix(importPath, "runtime/internal/") ||
+		strings.HasPrefix(importPath, "internal/runtime/")
+}
+
+// stdlibAsmDefines returns the preprocessor symbols the go command defines
+// when assembling standard library packages.
+func stdlibAsmDefines() []string {
+	goos, goarch := build.Default.GOOS, build.Default.GOARCH
+	defines := []string{"-D", "GOOS_" + goos, "-D", "GOARCH_" + goarch}
+	switch goarch {
+	case "386":
+		level := os.Getenv("GO386")
+		if level == "" {
+			level = "sse2"
+		}
+		defines = append(defines, "-D", "GO386_"+level)
+	case "amd64":
+		level := os.Getenv("GOAMD64")
+		if level == "" {
+			level = "v1"
+		}
+		defines = append(defines, "-D", "GOAMD64_"+level)
+	}
+	return defines
+}
+
+// releaseTagAtLeast reports whether the Go release this builder was built
+// with (which is the release of the SDK in use) includes the given release tag,
+// for example "go1.19".
+func releaseTagAtLeast(tag string) bool {
+	for _, t := range build.Default.ReleaseTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteFlag escapes a single flag value so that it survives splitting
+// by quoteMultiFlag.
+func quoteFlag(v string) string {
+	b := &strings.Builder{}
+	for _, r := range v {
+		if unicode.IsSpace(r) || r == '\'' || r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -96,9 +96,15 @@ type goListPackage struct {
 	TestEmbedFiles     []string // files matched by TestEmbedPatterns
 	XTestEmbedPatterns []string // //go:embed patterns in XTestGoFiles
 	XTestEmbedFiles    []string // files matched by XTestEmbedPatterns
+	// Cgo directives
+	CgoCFLAGS   []string // cgo: flags for C compiler
+	CgoCPPFLAGS []string // cgo: flags for C preprocessor
+	CgoCXXFLAGS []string // cgo: flags for C++ compiler
+	CgoLDFLAGS  []string // cgo: flags for linker
 	// Dependency information
 	Imports   []string          // import paths used by this package
 	ImportMap map[string]string // map from source import to ImportPath (identity entries omitted)
+	Deps      []string          // all (recursively) imported dependencies
 	// Error information
 	Incomplete bool                 // this package or a dependency has an error
 	Error      *flatPackagesError   // error loading package
@@ -177,11 +183,10 @@ func stdliblist(args []string) error {
 	os.Setenv("GOMODCACHE", cachePath)
 	os.Setenv("GOPATH", cachePath)
 
-	listArgs := goenv.goCmd("list")
-	if len(build.Default.BuildTags) > 0 {
-		listArgs = append(listArgs, "-tags", strings.Join(build.Default.BuildTags, ","))
+	pkgs, err := listStdlib(goenv, "builtin", "std", "runtime/cgo")
+	if err != nil {
+		return err
 	}
-	listArgs = append(listArgs, "-json", "builtin", "std", "runtime/cgo")
 
 	jsonFile, err := os.Create(*out)
 	if err != nil {
@@ -189,22 +194,40 @@ func stdliblist(args []string) error {
 	}
 	defer jsonFile.Close()
 
+	encoder := json.NewEncoder(jsonFile)
+	for _, pkg := range pkgs {
+		if err := encoder.Encode(flatPackageForStd(execRoot, pkg)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listStdlib runs `go list -json` with the configured build tags and returns
+// the decoded packages in the order they were printed. The environment
+// (GOROOT, GOOS, GOARCH, CGO_ENABLED) must already be set up by the caller.
+func listStdlib(goenv *env, args ...string) ([]*goListPackage, error) {
+	listArgs := goenv.goCmd("list")
+	if len(build.Default.BuildTags) > 0 {
+		listArgs = append(listArgs, "-tags", strings.Join(build.Default.BuildTags, ","))
+	}
+	listArgs = append(listArgs, "-json")
+	listArgs = append(listArgs, args...)
+
 	jsonData := &bytes.Buffer{}
 	if err := goenv.runCommandToFile(jsonData, listArgs); err != nil {
-		return err
+		return nil, err
 	}
 
-	encoder := json.NewEncoder(jsonFile)
+	var pkgs []*goListPackage
 	decoder := json.NewDecoder(jsonData)
 	for decoder.More() {
 		var pkg *goListPackage
 		if err := decoder.Decode(&pkg); err != nil {
-			return err
-		}
-		if err := encoder.Encode(flatPackageForStd(execRoot, pkg)); err != nil {
-			return err
+			return nil, err
 		}
+		pkgs = append(pkgs, pkg)
 	}
-
-	return nil
+	return pkgs, nil
 }
@@ -0,0 +1,230 @@
+// Copyright 2023 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// verify checks that archives are reproducible: that they don't contain
+// timestamps, user or group ids, absolute paths or build ids that would make
+// the output depend on the machine or the time of the build. It is invoked
+// manually (or by tests) to explain why an archive isn't cacheable; pack runs
+// the same checks on its output when -verify is set.
+func verify(args []string) error {
+	args, err := expandParamsFiles(args)
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("GoVerify", flag.ExitOnError)
+	var roots multiFlag
+	flags.Var(&roots, "root", "Absolute path prefix that must not appear in archives (may be repeated). Defaults to the output base.")
+	report := flags.String("report", "", "Path to the report file. If not set, the report is written to stderr.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("no archives to verify")
+	}
+	if len(roots) == 0 {
+		roots = defaultVerifyRoots()
+	}
+
+	var issues []archiveIssue
+	for _, archive := range flags.Args() {
+		archiveIssues, err := verifyArchive(archive, roots)
+		if err != nil {
+			return err
+		}
+		issues = append(issues, archiveIssues...)
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+
+	text := formatArchiveIssues(issues)
+	if *report == "" {
+		fmt.Fprint(os.Stderr, text)
+	} else if err := ioutil.WriteFile(*report, []byte(text), 0666); err != nil {
+		return err
+	}
+	return fmt.Errorf("found %d reproducibility issues", len(issues))
+}
+
+// archiveIssue describes something in an archive member that makes the
+// archive depend on the environment it was built in.
+type archiveIssue struct {
+	archive, member, problem string
+}
+
+func (i archiveIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.archive, i.member, i.problem)
+}
+
+func formatArchiveIssues(issues []archiveIssue) string {
+	var buf strings.Builder
+	for _, i := range issues {
+		buf.WriteString(i.String())
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// verifyArchive reads each member of an archive and reports anything that
+// makes it non-deterministic. roots is a list of absolute path prefixes
+// (for example, the Bazel output base) that must not appear in the names
+// or the contents of members.
+func verifyArchive(archive string, roots []string) ([]archiveIssue, error) {
+	rc, err := openArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var issues []archiveIssue
+	report := func(member, format string, args ...interface{}) {
+		issues = append(issues, archiveIssue{
+			archive: archive,
+			member:  member,
+			problem: fmt.Sprintf(format, args...),
+		})
+	}
+
+	var nameData []byte
+	for {
+		hdr, name, size, err := readEntry(rc.Reader, &nameData)
+		if err == io.EOF {
+			return issues, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", archive, err)
+		}
+		if !isZeroField(hdr.ModTimeRaw[:]) {
+			report(name, "modification time is %s, want 0", strings.TrimSpace(string(hdr.ModTimeRaw[:])))
+		}
+		if !isZeroField(hdr.OwnerIdRaw[:]) {
+			report(name, "owner id is %s, want 0", strings.TrimSpace(string(hdr.OwnerIdRaw[:])))
+		}
+		if !isZeroField(hdr.GroupIdRaw[:]) {
+			report(name, "group id is %s, want 0", strings.TrimSpace(string(hdr.GroupIdRaw[:])))
+		}
+		if isAbsPath(name) {
+			report(name, "member name is an absolute path")
+		}
+		if rc.thin {
+			// Members of thin archives are stored outside the archive.
+			continue
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(rc.Reader, data); err != nil {
+			return nil, fmt.Errorf("%s: reading %s: %v", archive, name, err)
+		}
+		if size%2 != 0 {
+			if _, err := rc.Reader.ReadByte(); err != nil && err != io.EOF {
+				return nil, fmt.Errorf("%s: reading %s: %v", archive, name, err)
+			}
+		}
+		for _, root := range roots {
+			if i := bytes.Index(data, []byte(root)); i >= 0 {
+				report(name, "contains absolute path %q at offset %d", root, i)
+			}
+		}
+		if id := goObjectBuildID(data); id != "" {
+			report(name, "contains Go build id %q", id)
+		}
+	}
+}
+
+// isZeroField returns whether an archive header field is empty or 0, which
+// is what "go tool pack" and "ar D" write.
+func isZeroField(field []byte) bool {
+	s := strings.TrimSpace(string(field))
+	return s == "" || s == "0"
+}
+
+// isAbsPath is like filepath.IsAbs, but it recognizes absolute paths from
+// any platform, since archives may be built on one and inspected on another.
+func isAbsPath(path string) bool {
+	if strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\`) {
+		return true
+	}
+	return len(path) >= 3 && path[1] == ':' && (path[2] == '/' || path[2] == '\\')
+}
+
+// goObjectBuildID returns the build id recorded in the header of a Go object
+// file or export data file, or "" if data is not a Go object or has no build
+// id. The compiler only writes one when -buildid is passed; the go command
+// does, but the builder should not.
+func goObjectBuildID(data []byte) string {
+	if !bytes.HasPrefix(data, []byte("go object ")) {
+		return ""
+	}
+	// The header is a sequence of lines terminated by an empty line or by
+	// the "!" line that starts the export data.
+	for _, line := range strings.Split(string(data[:headerEnd(data)]), "\n") {
+		if strings.HasPrefix(line, "build id ") {
+			return strings.Trim(strings.TrimPrefix(line, "build id "), `"`)
+		}
+	}
+	return ""
+}
+
+func headerEnd(data []byte) int {
+	end := len(data)
+	if end > 4096 {
+		end = 4096
+	}
+	for _, sep := range []string{"\n\n", "\n!\n"} {
+		if i := bytes.Index(data[:end], []byte(sep)); i >= 0 {
+			end = i
+		}
+	}
+	return end
+}
+
+// defaultVerifyRoots returns the path prefixes verify looks for when none are
+// given on the command line. Actions run in the execroot or a sandbox under
+// the output base, so any path beneath the output base is specific to this
+// machine and workspace.
+func defaultVerifyRoots() []string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	root := wd
+	for _, marker := range []string{"/sandbox/", "/execroot/"} {
+		if i := strings.Index(filepath.ToSlash(wd), marker); i > 0 {
+			root = wd[:i]
+			break
+		}
+	}
+	if root == "/" || root == filepath.VolumeName(root)+`\` {
+		return nil
+	}
+	roots := []string{root}
+	if slashRoot := filepath.ToSlash(root); slashRoot != root {
+		roots = append(roots, slashRoot)
+	}
+	return roots
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testMember struct {
+	name, mtime, uid, gid, data string
+}
+
+func writeTestArchive(t *testing.T, members []testMember) string {
+	var buf strings.Builder
+	buf.WriteString(arHeader)
+	for _, m := range members {
+		fmt.Fprintf(&buf, "%-16s%-12s%-6s%-6s%-8s%-10d`\n", m.name, m.mtime, m.uid, m.gid, "644", len(m.data))
+		buf.WriteString(m.data)
+		if len(m.data)%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+	path := filepath.Join(t.TempDir(), "lib.a")
+	if err := ioutil.WriteFile(path, []byte(buf.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyArchive(t *testing.T) {
+	const root = "/home/user/.cache/bazel/_bazel_user/1234"
+	for _, test := range []struct {
+		desc    string
+		members []testMember
+		want    []string
+	}{
+		{
+			desc: "clean",
+			members: []testMember{
+				{name: "__.PKGDEF", mtime: "0", uid: "0", gid: "0", data: "go object linux amd64 go1.21 X:none\n\n$$B\n"},
+				{name: "_go_.o", mtime: "0", uid: "0", gid: "0", data: "go object linux amd64 go1.21 X:none\n!\nobj"},
+				{name: "foo.o", mtime: "", uid: "", gid: "", data: "\x7fELF"},
+			},
+		},
+		{
+			desc: "metadata",
+			members: []testMember{
+				{name: "foo.o/", mtime: "1672531200", uid: "1000", gid: "100", data: "\x7fELF"},
+			},
+			want: []string{
+				"foo.o: modification time is 1672531200, want 0",
+				"foo.o: owner id is 1000, want 0",
+				"foo.o: group id is 100, want 0",
+			},
+		},
+		{
+			desc: "abs_path",
+			members: []testMember{
+				{name: "bar.o", mtime: "0", uid: "0", gid: "0", data: "\x7fELF..." + root + "/execroot/main/bar.c"},
+			},
+			want: []string{
+				fmt.Sprintf("bar.o: contains absolute path %q at offset 7", root),
+			},
+		},
+		{
+			desc: "build_id",
+			members: []testMember{
+				{name: "_go_.o", mtime: "0", uid: "0", gid: "0", data: "go object linux amd64 go1.21 X:none\nbuild id \"abc/def\"\n!\nobj"},
+			},
+			want: []string{
+				`_go_.o: contains Go build id "abc/def"`,
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			archive := writeTestArchive(t, test.members)
+			issues, err := verifyArchive(archive, []string{root})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, i := range issues {
+				got = append(got, strings.TrimPrefix(i.String(), archive+": "))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
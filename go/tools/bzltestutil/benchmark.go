@@ -0,0 +1,144 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// benchmarkFile is the name of the file benchmark results are written to,
+// in TEST_UNDECLARED_OUTPUTS_DIR, in the format read by benchstat.
+const benchmarkFile = "benchmarks.txt"
+
+// benchmarkResult is a result line printed by a benchmark, like
+//
+//	BenchmarkFoo-8   	 1000000	      1052 ns/op	     128 B/op	       2 allocs/op
+type benchmarkResult struct {
+	// name is the name of the benchmark, including the GOMAXPROCS suffix
+	// like the reports of the testing package.
+	name       string
+	iterations int
+	// metrics are the measurements of the benchmark, in the order they were
+	// printed, like ns/op, B/op, allocs/op and those reported with
+	// b.ReportMetric.
+	metrics []benchmarkMetric
+}
+
+type benchmarkMetric struct {
+	value float64
+	unit  string
+}
+
+// benchmarkConfigKeys are the configuration lines printed by the testing
+// package before the results of benchmarks.
+var benchmarkConfigKeys = []string{"goos", "goarch", "pkg", "cpu"}
+
+// parseBenchmarkResult parses a result line of a benchmark, or returns
+// false if line isn't one.
+func parseBenchmarkResult(line string) (*benchmarkResult, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || len(fields)%2 != 0 || !isBenchmarkName([]byte(fields[0])) {
+		return nil, false
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, false
+	}
+	r := &benchmarkResult{name: fields[0], iterations: n}
+	for i := 2; i < len(fields); i += 2 {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, false
+		}
+		r.metrics = append(r.metrics, benchmarkMetric{value: v, unit: fields[i+1]})
+	}
+	return r, true
+}
+
+// parseBenchmarks returns the results of the benchmarks printed in output,
+// the standard output of a test binary, and the configuration lines printed
+// before them.
+func parseBenchmarks(output string) (config []string, results []*benchmarkResult) {
+	for _, line := range strings.Split(output, "\n") {
+		if r, ok := parseBenchmarkResult(line); ok {
+			results = append(results, r)
+			continue
+		}
+		for _, key := range benchmarkConfigKeys {
+			if strings.HasPrefix(line, key+": ") {
+				config = append(config, line)
+			}
+		}
+	}
+	return config, results
+}
+
+// benchmarkProperties returns the mean of the metrics of results, which are
+// several runs of the same benchmark, as properties of its test case.
+func benchmarkProperties(results []*benchmarkResult) []xmlProperty {
+	var units []string
+	sums := map[string]float64{}
+	counts := map[string]int{}
+	iterations := 0
+	for _, r := range results {
+		iterations += r.iterations
+		for _, m := range r.metrics {
+			if _, ok := sums[m.unit]; !ok {
+				units = append(units, m.unit)
+			}
+			sums[m.unit] += m.value
+			counts[m.unit]++
+		}
+	}
+	props := []xmlProperty{{Name: "iterations", Value: strconv.Itoa(iterations)}}
+	if len(results) > 1 {
+		props = append(props, xmlProperty{Name: "runs", Value: strconv.Itoa(len(results))})
+	}
+	for _, unit := range units {
+		mean := sums[unit] / float64(counts[unit])
+		props = append(props, xmlProperty{Name: unit, Value: strconv.FormatFloat(mean, 'g', -1, 64)})
+	}
+	return props
+}
+
+// writeBenchmarks writes the results of the benchmarks of suite to path,
+// in the format read by benchstat, or nothing if no benchmark ran.
+func writeBenchmarks(suite *testSuite, pkg string, path string) error {
+	if len(suite.benchmarks) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	hasPkg := false
+	for _, line := range suite.benchmarkConfig {
+		hasPkg = hasPkg || strings.HasPrefix(line, "pkg: ")
+		fmt.Fprintln(&b, line)
+	}
+	// The testing package only knows the import path of the package when
+	// it's set by go test.
+	if !hasPkg {
+		fmt.Fprintf(&b, "pkg: %s\n", pkg)
+	}
+	for _, r := range suite.benchmarks {
+		fmt.Fprintf(&b, "%s\t%d", r.name, r.iterations)
+		for _, m := range r.metrics {
+			fmt.Fprintf(&b, "\t%s %s", strconv.FormatFloat(m.value, 'f', -1, 64), m.unit)
+		}
+		fmt.Fprintln(&b)
+	}
+	return ioutil.WriteFile(path, []byte(b.String()), 0664)
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseBenchmarkResult(t *testing.T) {
+	var tests = []struct {
+		line string
+		want *benchmarkResult
+	}{
+		{
+			line: "BenchmarkFoo-8   \t 1000000\t      1052 ns/op\t     128 B/op\t       2 allocs/op\n",
+			want: &benchmarkResult{
+				name:       "BenchmarkFoo-8",
+				iterations: 1000000,
+				metrics: []benchmarkMetric{
+					{value: 1052, unit: "ns/op"},
+					{value: 128, unit: "B/op"},
+					{value: 2, unit: "allocs/op"},
+				},
+			},
+		}, {
+			line: "BenchmarkBar/size=10-8 \t 500\t 2.5e+06 ns/op\t 12.50 MB/s\t 3.000 widgets/op",
+			want: &benchmarkResult{
+				name:       "BenchmarkBar/size=10-8",
+				iterations: 500,
+				metrics: []benchmarkMetric{
+					{value: 2.5e6, unit: "ns/op"},
+					{value: 12.5, unit: "MB/s"},
+					{value: 3, unit: "widgets/op"},
+				},
+			},
+		}, {
+			line: "BenchmarkFoo",
+		}, {
+			line: "Benchmarking 100 ns/op 1",
+		}, {
+			line: "    bench_test.go:12: BenchmarkFoo 1 2 ns/op",
+		},
+	}
+	for _, tt := range tests {
+		got, ok := parseBenchmarkResult(tt.line)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseBenchmarkResult(%q) = %+v, expected %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestBenchmarkResults(t *testing.T) {
+	events := []event{
+		{Action: "run", Test: "TestA"},
+		{Action: "output", Test: "TestA", Output: "--- PASS: TestA (0.00s)\n"},
+		{Action: "pass", Test: "TestA"},
+		{Action: "output", Output: "goos: linux\n"},
+		{Action: "output", Output: "goarch: amd64\n"},
+		// Benchmark lines are split at the first tab by the converter.
+		{Action: "output", Output: "BenchmarkFoo-8   \t"},
+		{Action: "output", Output: "    1000\t      2000 ns/op\t      16 B/op\n"},
+		{Action: "output", Output: "BenchmarkFoo-8   \t    3000\t      1000 ns/op\t      32 B/op\n"},
+		{Action: "output", Output: "PASS\n"},
+		{Action: "pass"},
+	}
+	suite := parseEvents(events)
+
+	result := toXML("pkg/testing", suite).Suites[0]
+	var bench *xmlTestCase
+	for i, c := range result.TestCases {
+		if c.Name == "BenchmarkFoo-8" {
+			bench = &result.TestCases[i]
+		}
+	}
+	if bench == nil {
+		t.Fatalf("no test case for BenchmarkFoo-8 in %+v", result.TestCases)
+	}
+	if bench.Failure != nil || bench.Error != nil || bench.Time != "0.005" {
+		t.Errorf("BenchmarkFoo-8 should pass in 0.005s, got %+v", bench)
+	}
+	wantProps := &xmlProperties{Properties: []xmlProperty{
+		{Name: "elapsed", Value: "0.005"},
+		{Name: "iterations", Value: "4000"},
+		{Name: "runs", Value: "2"},
+		{Name: "ns/op", Value: "1500"},
+		{Name: "B/op", Value: "24"},
+	}}
+	if !reflect.DeepEqual(bench.Properties, wantProps) {
+		t.Errorf("got properties %+v, expected %+v", bench.Properties, wantProps)
+	}
+
+	path := filepath.Join(t.TempDir(), benchmarkFile)
+	if err := writeBenchmarks(suite, "pkg/testing", path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `goos: linux
+goarch: amd64
+pkg: pkg/testing
+BenchmarkFoo-8	1000	2000 ns/op	16 B/op
+BenchmarkFoo-8	3000	1000 ns/op	32 B/op
+`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, want)
+	}
+}
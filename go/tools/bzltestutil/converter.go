@@ -33,14 +33,15 @@ const (
 	Stderr    Mode = 2 << iota // put everything in output without parsing
 )
 
-// event is the struct we emit.
+// event is the struct we emit. Its JSON encoding is that of the events
+// printed by go test -json.
 type event struct {
-	Time    *time.Time
+	Time    *time.Time `json:",omitempty"`
 	Action  string
-	Package string
-	Test    string
-	Elapsed *float64
-	Output  string
+	Package string   `json:",omitempty"`
+	Test    string   `json:",omitempty"`
+	Elapsed *float64 `json:",omitempty"`
+	Output  string   `json:",omitempty"`
 }
 
 type MixedConverter struct {
@@ -0,0 +1,153 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// fuzzCacheDirName is the directory the corpus generated by fuzzing is
+	// written to, in TEST_UNDECLARED_OUTPUTS_DIR.
+	fuzzCacheDirName = "fuzz_cache"
+
+	// fuzzCrashersDirName is the directory the failing inputs found by
+	// fuzzing are copied to, in TEST_UNDECLARED_OUTPUTS_DIR, like
+	// fuzz_crashers/FuzzFoo/582528ddfad69eb5.
+	fuzzCrashersDirName = "fuzz_crashers"
+)
+
+// failingInputRegexp matches the line printed by the testing package when
+// fuzzing finds a failing input, with the path of the file it was written
+// to, relative to the directory of the test.
+var failingInputRegexp = regexp.MustCompile(`(?m)^\s*Failing input written to (\S+)$`)
+
+// FuzzCacheDir returns the directory where the test binary of pkg caches
+// the inputs generated by fuzzing, which go test keeps in GOCACHE. Under
+// bazel test, it's in TEST_UNDECLARED_OUTPUTS_DIR, the only directory the test
+// may write to. Bazel clears it before each run, so the corpus isn't reused by
+// later runs, but it is kept in the test outputs. Otherwise, it's in the user
+// cache directory.
+func FuzzCacheDir(pkg string) string {
+	if outputsDir, ok := os.LookupEnv("TEST_UNDECLARED_OUTPUTS_DIR"); ok {
+		return filepath.Join(outputsDir, fuzzCacheDirName)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, "rules_go_fuzz", pkg)
+}
+
+// fuzzArgs returns args with a -test.fuzztime flag bounding the time spent
+// fuzzing to half of TEST_TIMEOUT, if a fuzz target is run without one.
+// Otherwise, fuzzing would only stop when Bazel terminates the test.
+func fuzzArgs(args []string) []string {
+	if v, ok := testFlag(args, "test.fuzz"); !ok || v == "" {
+		return args
+	}
+	if _, ok := testFlag(args, "test.fuzztime"); ok {
+		return args
+	}
+	seconds, err := strconv.Atoi(os.Getenv("TEST_TIMEOUT"))
+	if err != nil || seconds <= 0 {
+		return args
+	}
+	fuzzTime := time.Duration(seconds) * time.Second / 2
+	return append(args, "-test.fuzztime="+fuzzTime.String())
+}
+
+// testFlag returns the value of the flag name in args, if it is set.
+func testFlag(args []string, name string) (string, bool) {
+	value, found := "", false
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimLeft(args[i], "-")
+		if arg == name && i+1 < len(args) {
+			i++
+			value, found = args[i], true
+		} else if strings.HasPrefix(arg, name+"=") {
+			value, found = strings.TrimPrefix(arg, name+"="), true
+		}
+	}
+	return value, found
+}
+
+// saveCrashers copies the failing inputs found by the fuzz targets of s to
+// outputsDir, since they are written to the testdata directory of the test,
+// which doesn't outlive it. Their new paths are recorded in the test case
+// of the fuzz target, to be reported with its failure.
+//
+// The testing package always writes failing inputs to testdata/fuzz in the
+// working directory, which is in the runfiles of the test, and has no flag to
+// write them elsewhere. If the runfiles are read-only, it fails to write them
+// and there is nothing to copy; if they are symlinks to the workspace, the
+// inputs are also left in the source tree.
+func (s *testSuite) saveCrashers(outputsDir string) error {
+	for name, c := range s.cases {
+		if c.state != "fail" {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, match := range failingInputRegexp.FindAllStringSubmatch(c.output.String(), -1) {
+			if seen[match[1]] {
+				continue
+			}
+			seen[match[1]] = true
+			data, err := ioutil.ReadFile(match[1])
+			if err != nil {
+				return err
+			}
+			dir := filepath.Join(outputsDir, fuzzCrashersDirName, name)
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				return err
+			}
+			path := filepath.Join(dir, filepath.Base(match[1]))
+			if err := ioutil.WriteFile(path, data, 0664); err != nil {
+				return err
+			}
+			c.crashers = append(c.crashers, crasher{path: path, data: string(data)})
+		}
+	}
+	return nil
+}
+
+// crasher is a failing input found by fuzzing.
+type crasher struct {
+	// path is where the input was saved in the undeclared outputs.
+	path string
+	// data is the content of the file, in the format of the seed corpus.
+	data string
+}
+
+// crasherReport describes the failing inputs of a fuzz target, for the
+// failure of its test case.
+func crasherReport(crashers []crasher) string {
+	var b strings.Builder
+	for _, c := range crashers {
+		rel := filepath.ToSlash(filepath.Join(fuzzCrashersDirName, filepath.Base(filepath.Dir(c.path)), filepath.Base(c.path)))
+		fmt.Fprintf(&b, "Failing input saved as %s in the undeclared outputs. To add it to the seed corpus, copy it to testdata/fuzz:\n%s", rel, c.data)
+		if !strings.HasSuffix(c.data, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFuzzArgs(t *testing.T) {
+	var tests = []struct {
+		name    string
+		args    []string
+		timeout string
+		want    []string
+	}{
+		{
+			name:    "no_fuzzing",
+			args:    []string{"-test.v"},
+			timeout: "300",
+			want:    []string{"-test.v"},
+		}, {
+			name:    "fuzzing",
+			args:    []string{"-test.fuzz=FuzzFoo"},
+			timeout: "300",
+			want:    []string{"-test.fuzz=FuzzFoo", "-test.fuzztime=2m30s"},
+		}, {
+			name:    "fuzztime",
+			args:    []string{"-test.fuzz", "FuzzFoo", "--test.fuzztime=1000x"},
+			timeout: "300",
+			want:    []string{"-test.fuzz", "FuzzFoo", "--test.fuzztime=1000x"},
+		}, {
+			name: "no_timeout",
+			args: []string{"-test.fuzz=FuzzFoo"},
+			want: []string{"-test.fuzz=FuzzFoo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("TEST_TIMEOUT", tt.timeout)
+			defer os.Unsetenv("TEST_TIMEOUT")
+			if got := fuzzArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fuzzArgs returned %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveCrashers(t *testing.T) {
+	dir := t.TempDir()
+	crashDir := filepath.Join(dir, "testdata", "fuzz", "FuzzFoo")
+	if err := os.MkdirAll(crashDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	input := "go test fuzz v1\n[]byte(\"\\x00\")\n"
+	crashFile := filepath.Join(crashDir, "582528ddfad69eb5")
+	if err := ioutil.WriteFile(crashFile, []byte(input), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	suite := parseEvents([]event{
+		{Action: "run", Test: "FuzzFoo"},
+		{Action: "output", Test: "FuzzFoo", Output: "--- FAIL: FuzzFoo (0.10s)\n"},
+		{Action: "output", Test: "FuzzFoo", Output: "    --- FAIL: FuzzFoo (0.00s)\n        foo_test.go:12: zero byte\n"},
+		{Action: "output", Test: "FuzzFoo", Output: "    Failing input written to " + crashFile + "\n"},
+		{Action: "output", Test: "FuzzFoo", Output: "Failing input written to " + crashFile + "\n"},
+		{Action: "fail", Test: "FuzzFoo"},
+		{Action: "fail"},
+	})
+	outputsDir := filepath.Join(dir, "outputs")
+	if err := suite.saveCrashers(outputsDir); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := filepath.Join(outputsDir, fuzzCrashersDirName, "FuzzFoo", "582528ddfad69eb5")
+	if data, err := ioutil.ReadFile(saved); err != nil {
+		t.Fatal(err)
+	} else if string(data) != input {
+		t.Errorf("got saved input %q, expected %q", data, input)
+	}
+
+	if n := len(suite.cases["FuzzFoo"].crashers); n != 1 {
+		t.Errorf("got %d crashers, expected 1", n)
+	}
+	c := toXML("pkg/testing", suite).Suites[0].TestCases[0]
+	if c.Failure == nil || !strings.Contains(c.Failure.Contents, "fuzz_crashers/FuzzFoo/582528ddfad69eb5") || !strings.Contains(c.Failure.Contents, input) {
+		t.Errorf("failure should describe the failing input, got %+v", c.Failure)
+	}
+	if want := "[[ATTACHMENT|" + saved + "]]\n"; !strings.HasSuffix(c.Stdout.Contents, want) {
+		t.Errorf("output should end with %q, got %q", want, c.Stdout.Contents)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// shardTimingsEnv names the timing file used to balance the tests of a
+// sharded target. It is set by the shard_timings attribute of go_test.
+const shardTimingsEnv = "GO_TEST_SHARD_TIMINGS"
+
+// AssignShards returns the shard each of the tests named in tests should
+// run in, or nil if no timing file is configured, in which case tests are
+// assigned round-robin.
+//
+// Tests with a recorded duration are balanced across shards, longest first,
+// each going to the shard with the least total duration so far. Tests
+// without one, like new tests, are assigned by a hash of their name, so that
+// adding a test doesn't move the others, and are counted with the average
+// duration of the recorded tests.
+func AssignShards(tests []string, totalShards int) []int {
+	path := shardTimingsFile()
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	var timings map[string]float64
+	if err == nil {
+		timings, err = readTimings(f)
+		f.Close()
+	}
+	if err != nil {
+		// Hashing alone still gives every shard the same tests each run.
+		fmt.Fprintf(os.Stderr, "bzltestutil: could not read shard timings: %v\n", err)
+	}
+	return assignShards(tests, timings, totalShards)
+}
+
+// shardTimingsFile returns the path of the timing file, relative to the
+// root of the workspace in the runfiles if it isn't absolute.
+func shardTimingsFile() string {
+	path := os.Getenv(shardTimingsEnv)
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(os.Getenv("TEST_SRCDIR"), os.Getenv("TEST_WORKSPACE"), path)
+}
+
+func assignShards(tests []string, timings map[string]float64, totalShards int) []int {
+	shards := make([]int, len(tests))
+	load := make([]float64, totalShards)
+
+	var total float64
+	var timed []int
+	for i, name := range tests {
+		if d, ok := timings[name]; ok {
+			timed = append(timed, i)
+			total += d
+		}
+	}
+	var average float64
+	if len(timed) > 0 {
+		average = total / float64(len(timed))
+	}
+
+	for i, name := range tests {
+		if _, ok := timings[name]; ok {
+			continue
+		}
+		h := fnv.New32a()
+		io.WriteString(h, name)
+		shards[i] = int(h.Sum32() % uint32(totalShards))
+		load[shards[i]] += average
+	}
+
+	sort.SliceStable(timed, func(i, j int) bool {
+		di, dj := timings[tests[timed[i]]], timings[tests[timed[j]]]
+		if di != dj {
+			return di > dj
+		}
+		return tests[timed[i]] < tests[timed[j]]
+	})
+	for _, i := range timed {
+		min := 0
+		for s := range load {
+			if load[s] < load[min] {
+				min = s
+			}
+		}
+		shards[i] = min
+		load[min] += timings[tests[i]]
+	}
+	return shards
+}
+
+// readTimings reads a timing file, as written by the shard_timings tool.
+// Each line holds the name of a top-level test and its duration in seconds,
+// separated by whitespace. Empty lines and lines starting with # are ignored.
+func readTimings(r io.Reader) (map[string]float64, error) {
+	timings := map[string]float64{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a test name and a duration", line)
+		}
+		d, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("line %d: invalid duration %q", line, fields[1])
+		}
+		timings[fields[0]] = d
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return timings, nil
+}
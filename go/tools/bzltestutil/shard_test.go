@@ -0,0 +1,66 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadTimings(t *testing.T) {
+	got, err := readTimings(strings.NewReader(`# generated by shard_timings
+
+TestA 1.5
+TestB	0.010
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"TestA": 1.5, "TestB": 0.01}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"TestA\n", "TestA 1 2\n", "TestA fast\n", "TestA -1\n"} {
+		if _, err := readTimings(strings.NewReader(bad)); err == nil {
+			t.Errorf("reading %q: got no error", bad)
+		}
+	}
+}
+
+func TestAssignShards(t *testing.T) {
+	tests := []string{"TestA", "TestB", "TestC", "TestD", "TestE"}
+
+	// Round-robin would put both slow tests in shard 0.
+	timings := map[string]float64{"TestA": 10, "TestB": 1, "TestC": 9, "TestD": 1, "TestE": 1}
+	got := assignShards(tests, timings, 2)
+	want := []int{0, 1, 1, 0, 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("with timings: got %v, want %v", got, want)
+	}
+
+	// Without timings, each test is assigned by its name alone.
+	hashed := assignShards(tests, nil, 3)
+	subset := assignShards(tests[1:4], nil, 3)
+	if !reflect.DeepEqual(hashed[1:4], subset) {
+		t.Errorf("assignments changed when tests were removed: got %v, then %v", hashed, subset)
+	}
+	for i, s := range hashed {
+		if s < 0 || s >= 3 {
+			t.Errorf("%s assigned to shard %d of 3", tests[i], s)
+		}
+	}
+}
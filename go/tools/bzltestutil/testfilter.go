@@ -0,0 +1,111 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ParseTestFilter translates the value of --test_filter, which Bazel passes
+// in TESTBRIDGE_TEST_ONLY, into patterns for the -test.run and -test.skip
+// flags of the test binary. Either may be empty.
+//
+// The filter is a comma-separated list of patterns, each matching tests
+// like a -test.run pattern: the names of tests and their subtests are
+// matched by the slash-separated regular expressions of the pattern.
+// Patterns starting with - exclude the tests they match. For example,
+// "TestFoo/case_1,TestBar,-TestBar/slow" runs the case_1 subtest of TestFoo
+// and TestBar without its slow subtest.
+//
+// Commas and slashes in brackets, parentheses or braces, or escaped with a
+// backslash, are part of regular expressions. Elements of patterns that
+// aren't valid regular expressions, like a subtest named "f(x", are matched
+// literally. A filter with a single pattern is thus passed as is.
+//
+// Before Go 1.20, the testing package splits -test.run patterns on slashes
+// before alternations, so alternatives can't filter subtests separately.
+// With several patterns to run, only their top-level tests are then
+// matched, and all of their subtests run.
+func ParseTestFilter(filter string) (run, skip string) {
+	var runs, skips []string
+	for _, pattern := range splitFilter(filter, ',') {
+		pattern = strings.TrimSpace(pattern)
+		negative := strings.HasPrefix(pattern, "-")
+		if negative {
+			pattern = pattern[1:]
+		}
+		if pattern == "" {
+			continue
+		}
+		// Alternations are split too, so that the subtests of each
+		// alternative are matched separately, like the testing package does.
+		for _, alt := range splitFilter(pattern, '|') {
+			elems := splitFilter(alt, '/')
+			for i, elem := range elems {
+				if _, err := regexp.Compile(elem); err != nil {
+					elems[i] = regexp.QuoteMeta(elem)
+				}
+			}
+			if negative {
+				skips = append(skips, strings.Join(elems, "/"))
+			} else {
+				runs = append(runs, strings.Join(elems, "/"))
+			}
+		}
+	}
+	if !splitsAlternatives && len(runs) > 1 {
+		runs = topLevelPatterns(runs)
+	}
+	return strings.Join(runs, "|"), strings.Join(skips, "|")
+}
+
+// topLevelPatterns returns the parts of patterns matching top-level tests,
+// without duplicates.
+func topLevelPatterns(patterns []string) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		top := splitFilter(pattern, '/')[0]
+		if !seen[top] {
+			seen[top] = true
+			ret = append(ret, top)
+		}
+	}
+	return ret
+}
+
+// splitFilter splits s around the occurrences of sep that aren't escaped
+// or nested in brackets, parentheses or braces.
+func splitFilter(s string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '[' || c == '(' || c == '{':
+			depth++
+		case c == ']' || c == ')' || c == '}':
+			if depth > 0 {
+				depth--
+			}
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,22 @@
+// +build !go1.20
+
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+// splitsAlternatives is whether the testing package splits -test.run
+// patterns on top-level alternations before slashes, so that each
+// alternative filters subtests separately. It does since Go 1.20.
+var splitsAlternatives = false
@@ -0,0 +1,89 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import "testing"
+
+func TestParseTestFilter(t *testing.T) {
+	var tests = []struct {
+		filter    string
+		preGo120  bool
+		run, skip string
+	}{
+		{
+			filter: "",
+		}, {
+			filter: "TestFoo",
+			run:    "TestFoo",
+		}, {
+			filter: "^TestFoo$|^TestBar$",
+			run:    "^TestFoo$|^TestBar$",
+		}, {
+			filter: "TestFoo/case_1",
+			run:    "TestFoo/case_1",
+		}, {
+			filter: "TestFoo/case_1,TestBar",
+			run:    "TestFoo/case_1|TestBar",
+		}, {
+			filter: "TestFoo/a|TestBar/b",
+			run:    "TestFoo/a|TestBar/b",
+		}, {
+			filter: "TestFoo, TestBar ,",
+			run:    "TestFoo|TestBar",
+		}, {
+			filter: "-TestSlow",
+			skip:   "TestSlow",
+		}, {
+			filter: "TestBar,-TestBar/slow,-TestFlaky",
+			run:    "TestBar",
+			skip:   "TestBar/slow|TestFlaky",
+		}, {
+			filter: "-TestA|TestB",
+			skip:   "TestA|TestB",
+		}, {
+			filter: "Test(A|B)/x{1,2}",
+			run:    "Test(A|B)/x{1,2}",
+		}, {
+			filter: "TestSum/[a/b],TestSum/1\\,2",
+			run:    "TestSum/[a/b]|TestSum/1\\,2",
+		}, {
+			filter: "TestFoo/a+b)",
+			run:    "TestFoo/a\\+b\\)",
+		}, {
+			filter:   "TestFoo/case_1",
+			preGo120: true,
+			run:      "TestFoo/case_1",
+		}, {
+			filter:   "TestFoo/case_1,TestFoo/case_2,TestBar",
+			preGo120: true,
+			run:      "TestFoo|TestBar",
+		}, {
+			filter:   "Test(A|B)/x,-TestC/y",
+			preGo120: true,
+			run:      "Test(A|B)/x",
+			skip:     "TestC/y",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			defer func(split bool) { splitsAlternatives = split }(splitsAlternatives)
+			splitsAlternatives = !tt.preGo120
+			run, skip := ParseTestFilter(tt.filter)
+			if run != tt.run || skip != tt.skip {
+				t.Errorf("ParseTestFilter(%q) = %q, %q, expected %q, %q", tt.filter, run, skip, tt.run, tt.skip)
+			}
+		})
+	}
+}
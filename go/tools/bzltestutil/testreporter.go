@@ -94,7 +94,7 @@ func (o *Output) joinedOutput(prefix, suffix []byte) []byte {
 	if i := bytes.IndexByte(suffix, '\n'); i < len(suffix)/2 && i > 0 {
 		suffix = suffix[i:]
 	}
-	message := fmt.Sprintf("\n... Too big output (total: %d, skipped: %d) ...\n", o.size, o.size-uint64(len(prefix)+len(suffix)))
+	message := fmt.Sprintf("\n... Too big output (total: %d bytes, skipped: %d bytes) ...\n", o.size, o.size-uint64(len(prefix)+len(suffix)))
 	result := make([]byte, 0, len(prefix)+len(suffix)+len(message))
 	result = append(result, prefix...)
 	result = append(result, []byte(message)...)
@@ -15,6 +15,9 @@
 package bzltestutil
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,9 +26,12 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // TestWrapperAbnormalExit is used by Wrap to indicate the child
@@ -33,6 +39,15 @@ import (
 // We use 6, in line with Bazel's RUN_FAILURE.
 const TestWrapperAbnormalExit = 6
 
+// TestWrapperTimeoutExit is the exit code of the test when Wrap returns
+// ErrTestTimedOut. We use 124, like the timeout command.
+const TestWrapperTimeoutExit = 124
+
+// ErrTestTimedOut is returned by Wrap when the test binary was sent SIGQUIT
+// because the test was about to time out. The test is reported as timed out
+// in the XML_OUTPUT_FILE.
+var ErrTestTimedOut = errors.New("test timed out")
+
 func ShouldWrap() bool {
 	if wrapEnv, ok := os.LookupEnv("GO_TEST_WRAP"); ok {
 		wrap, err := strconv.ParseBool(wrapEnv)
@@ -59,20 +74,192 @@ func shouldAddTestV() bool {
 	return false
 }
 
-func Wrap(pkg string) error {
-	testOutputConverter := NewMixedConverter(pkg, Timestamp)
+// stackDumpFile is the name of the file the goroutine dump of a test that
+// hangs is written to, in TEST_UNDECLARED_OUTPUTS_DIR.
+const stackDumpFile = "goroutine_dump.txt"
+
+// testTimeout returns the timeout of the test set by Bazel in TEST_TIMEOUT,
+// or 0 if there is none.
+func testTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("TEST_TIMEOUT"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// stackDumpDeadline returns when the test binary should be sent SIGQUIT to
+// dump its goroutines, shortly before Bazel kills it once TEST_TIMEOUT is
+// exceeded, or the zero time if there is no timeout.
+func stackDumpDeadline(start time.Time) time.Time {
+	timeout := testTimeout()
+	if timeout == 0 {
+		return time.Time{}
+	}
+	// Leave enough time to write the dump and the test report.
+	margin := timeout / 20
+	if margin < time.Second {
+		margin = time.Second
+	} else if margin > 10*time.Second {
+		margin = 10 * time.Second
+	}
+	return start.Add(timeout - margin)
+}
+
+// stackDump records the output of the test binary once it was sent SIGQUIT,
+// which is the goroutine dump printed by the runtime.
+type stackDump struct {
+	mu      sync.Mutex
+	started bool
+	buf     bytes.Buffer
+}
+
+func (d *stackDump) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started {
+		d.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (d *stackDump) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = true
+}
 
+// save writes the dump to TEST_UNDECLARED_OUTPUTS_DIR, if the test binary was
+// sent SIGQUIT.
+func (d *stackDump) save() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	outputsDir, ok := os.LookupEnv("TEST_UNDECLARED_OUTPUTS_DIR")
+	if !d.started || !ok {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(outputsDir, stackDumpFile), d.buf.Bytes(), 0664)
+}
+
+// testEventsFile is the name of the file the test events are written to, in
+// TEST_UNDECLARED_OUTPUTS_DIR, in the format of go test -json.
+const testEventsFile = "test.json"
+
+// testLogFile is the name of the file the whole output of the test binary
+// is written to, in TEST_UNDECLARED_OUTPUTS_DIR, since the output of tests
+// is truncated in the test XML.
+const testLogFile = "test_output.log"
+
+// rerunAttempts returns how many times the wrapper should rerun the tests
+// that failed, until they pass. Only the failed top-level tests are run
+// again, which is faster than rerunning the whole binary with Bazel's
+// --flaky_test_attempts.
+func rerunAttempts() int {
+	if rerunEnv, ok := os.LookupEnv("GO_TEST_WRAP_RERUN_FAILED"); ok {
+		attempts, err := strconv.Atoi(rerunEnv)
+		if err != nil || attempts < 0 {
+			log.Fatalf("invalid value for GO_TEST_WRAP_RERUN_FAILED: %q", rerunEnv)
+		}
+		return attempts
+	}
+	return 0
+}
+
+func Wrap(pkg string) error {
 	args := os.Args[1:]
 	if shouldAddTestV() {
 		args = append([]string{"-test.v"}, args...)
 	}
+	args = fuzzArgs(args)
+
+	// Bazel fails the test if this file still exists when the wrapper
+	// exits, which catches test binaries exiting with status 0 before all
+	// tests ran, like when a goroutine calls os.Exit(0).
+	prematureExitFile := os.Getenv("TEST_PREMATURE_EXIT_FILE")
+	if prematureExitFile != "" {
+		if f, err := os.Create(prematureExitFile); err == nil {
+			f.Close()
+		}
+	}
 	exePath := os.Args[0]
 	if !filepath.IsAbs(exePath) && strings.ContainsRune(exePath, filepath.Separator) && testExecDir != "" {
 		exePath = filepath.Join(testExecDir, exePath)
 	}
+
+	start := time.Now()
+	deadline := stackDumpDeadline(start)
+	testOutputConverter, timeout, hung, err := runTests(pkg, exePath, args, deadline)
+	events := testOutputConverter.GetOutput()
+	suite := parseEvents(events)
+	attempts := rerunAttempts()
+	if fuzz, _ := testFlag(args, "test.fuzz"); fuzz != "" {
+		// Inputs found by fuzzing fail deterministically.
+		attempts = 0
+	}
+	for i := 0; i < attempts && !timeout && canRerun(testOutputConverter, err); i++ {
+		failed := suite.failedTests()
+		if len(failed) == 0 {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Rerunning failed tests (attempt %d): %s\n", i+2, strings.Join(failed, ", "))
+		testOutputConverter, timeout, hung, err = runTests(pkg, exePath, rerunArgs(args, failed), deadline)
+		events = append(events, testOutputConverter.GetOutput()...)
+		suite.addRerun(parseEvents(testOutputConverter.GetOutput()), failed)
+	}
+
+	if prematureExitFile != "" {
+		if exitedNormally(testOutputConverter) {
+			os.Remove(prematureExitFile)
+		} else if err == nil {
+			fmt.Fprintf(os.Stderr, "Test binary exited with status 0 before all tests completed\n")
+		}
+	}
+
+	if outputsDir, ok := os.LookupEnv("TEST_UNDECLARED_OUTPUTS_DIR"); ok {
+		if jerr := writeJSONEvents(events, filepath.Join(outputsDir, testEventsFile)); jerr != nil {
+			fmt.Fprintf(os.Stderr, "error while writing test events: %s\n", jerr)
+		}
+		if lerr := writeLog(events, filepath.Join(outputsDir, testLogFile)); lerr != nil {
+			fmt.Fprintf(os.Stderr, "error while writing test output: %s\n", lerr)
+		}
+		if berr := writeBenchmarks(suite, pkg, filepath.Join(outputsDir, benchmarkFile)); berr != nil {
+			fmt.Fprintf(os.Stderr, "error while writing benchmark results: %s\n", berr)
+		}
+		if ferr := suite.saveCrashers(outputsDir); ferr != nil {
+			fmt.Fprintf(os.Stderr, "error while saving failing fuzz inputs: %s\n", ferr)
+		}
+	}
+
+	if out, ok := os.LookupEnv("XML_OUTPUT_FILE"); ok {
+		werr := writeReport(suite, pkg, out)
+		if werr != nil {
+			if err != nil {
+				return fmt.Errorf("error while generating testreport: %s, (error wrapping test execution: %s)", werr, err)
+			}
+			return fmt.Errorf("error while generating testreport: %s", werr)
+		}
+	}
+
+	if hung {
+		// The test binary exited with status 2 after dumping its
+		// goroutines, which would look like any other failure.
+		return ErrTestTimedOut
+	}
+	return err
+}
+
+// runTests runs the test binary with args, and returns the converter of its
+// output, whether it was interrupted because the test timed out, whether
+// it was sent SIGQUIT because it hung, and the error it exited with. If
+// deadline is set, the test binary is sent SIGQUIT when it is reached, so
+// that the goroutine dump ends up in the output of the running test and in
+// TEST_UNDECLARED_OUTPUTS_DIR.
+func runTests(pkg, exePath string, args []string, deadline time.Time) (*MixedConverter, bool, bool, error) {
+	testOutputConverter := NewMixedConverter(pkg, Timestamp)
+	dump := &stackDump{}
 	cmd := exec.Command(exePath, args...)
 	cmd.Env = append(os.Environ(), "GO_TEST_WRAP=0")
-	cmd.Stderr = io.MultiWriter(os.Stderr, testOutputConverter.stderrConverter)
+	cmd.Stderr = io.MultiWriter(os.Stderr, testOutputConverter.stderrConverter, dump)
 	cmd.Stdout = io.MultiWriter(os.Stdout, testOutputConverter.stdoutConverter)
 
 	var err error
@@ -81,31 +268,133 @@ func Wrap(pkg string) error {
 
 	cancelChan := make(chan os.Signal, 1)
 	signal.Notify(cancelChan, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(cancelChan)
+	var dumpTimer <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		dumpTimer = timer.C
+	}
 	go func() {
 		processResult <- cmd.Run()
 	}()
-	select {
-	case err = <-processResult:
-	case <-cancelChan:
-		timeout = true
-		err = cmd.Process.Signal(os.Interrupt)
+	for done := false; !done; {
+		select {
+		case err = <-processResult:
+			done = true
+		case <-cancelChan:
+			timeout = true
+			err = cmd.Process.Signal(os.Interrupt)
+			done = true
+		case <-dumpTimer:
+			// The runtime prints the goroutines and exits. If the signal
+			// can't be sent, Bazel will terminate the test as usual.
+			dumpTimer = nil
+			timeout = true
+			dump.start()
+			fmt.Fprintf(os.Stderr, "Test is about to time out, sending SIGQUIT to dump goroutines\n")
+			cmd.Process.Signal(syscall.SIGQUIT)
+		}
+	}
+	if dump.started {
+		if derr := dump.save(); derr != nil {
+			fmt.Fprintf(os.Stderr, "error while saving goroutine dump: %s\n", derr)
+		}
+		// Report the test that was running as the one that timed out,
+		// rather than as skipped like the tests that didn't run.
+		if name := testOutputConverter.context.GetTestName(); name != "" {
+			testOutputConverter.stdoutConverter.writeEvent(&event{Action: "timeout", Test: name})
+		}
 	}
 	testOutputConverter.Close(timeout)
+	return testOutputConverter, timeout, dump.started, err
+}
 
-	if out, ok := os.LookupEnv("XML_OUTPUT_FILE"); ok {
-		werr := writeReport(testOutputConverter.GetOutput(), pkg, out)
-		if werr != nil {
-			if err != nil {
-				return fmt.Errorf("error while generating testreport: %s, (error wrapping test execution: %s)", werr, err)
+// exitedNormally returns whether the test binary returned from testing.M.Run,
+// which prints the overall result of the tests.
+func exitedNormally(c *MixedConverter) bool {
+	return c.context.result == "pass" || c.context.result == "fail"
+}
+
+// canRerun returns whether the failed tests of a run can be run again: the
+// test binary must have run all the tests and reported the failure, rather
+// than crashed, so that the tests that didn't fail are known to pass.
+func canRerun(c *MixedConverter, err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && c.context.result == "fail"
+}
+
+// rerunArgs returns args with a -test.run flag matching only tests, keeping
+// the filter on subtests of the original -test.run flag or
+// TESTBRIDGE_TEST_ONLY, if any. Subtests excluded by TESTBRIDGE_TEST_ONLY
+// are still skipped, since the test binary reads it again.
+func rerunArgs(args []string, tests []string) []string {
+	run, _ := ParseTestFilter(os.Getenv("TESTBRIDGE_TEST_ONLY"))
+	newArgs := make([]string, 0, len(args)+1)
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "test.run" && i+1 < len(args) {
+			i++
+			run = args[i]
+			continue
+		}
+		if strings.HasPrefix(name, "test.run=") {
+			run = strings.TrimPrefix(name, "test.run=")
+			continue
+		}
+		newArgs = append(newArgs, args[i])
+	}
+
+	quoted := make([]string, len(tests))
+	for i, test := range tests {
+		quoted[i] = regexp.QuoteMeta(test)
+	}
+	pattern := "^(" + strings.Join(quoted, "|") + ")$"
+	// Each alternative of run filters subtests separately, and all of them
+	// run if one of the alternatives doesn't filter them.
+	var alternatives []string
+	for _, alt := range splitFilter(run, '|') {
+		i := subtestSeparator(alt)
+		if i < 0 {
+			alternatives = nil
+			break
+		}
+		alternatives = append(alternatives, pattern+alt[i:])
+	}
+	// Before Go 1.20, alternatives can't filter subtests separately, so
+	// all the subtests of the failed tests run again.
+	if len(alternatives) == 1 || (len(alternatives) > 1 && splitsAlternatives) {
+		pattern = strings.Join(alternatives, "|")
+	}
+	return append(newArgs, "-test.run="+pattern)
+}
+
+// subtestSeparator returns the index of the slash separating the pattern
+// of top-level tests from that of subtests in a -test.run pattern, or -1.
+// Like the testing package, slashes in brackets or parentheses are ignored.
+func subtestSeparator(pattern string) int {
+	depth := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '[', '(':
+			depth++
+		case ']', ')':
+			if depth > 0 {
+				depth--
+			}
+		case '\\':
+			i++
+		case '/':
+			if depth == 0 {
+				return i
 			}
-			return fmt.Errorf("error while generating testreport: %s", werr)
 		}
 	}
-	return err
+	return -1
 }
 
-func writeReport(events []event, pkg string, path string) error {
-	xml, cerr := events2xml(events, pkg)
+func writeReport(suite *testSuite, pkg string, path string) error {
+	xml, cerr := suite2xml(suite, pkg)
 	if cerr != nil {
 		return fmt.Errorf("error converting test output to xml: %s", cerr)
 	}
@@ -114,3 +403,34 @@ func writeReport(events []event, pkg string, path string) error {
 	}
 	return nil
 }
+
+// writeJSONEvents writes events to path as newline-delimited JSON, like
+// go test -json, so that tools reading its output can be used on the
+// results of bazel test. Standard error is reported as output, and tests
+// that timed out as failed, since go test -json has no such actions.
+func writeJSONEvents(events []event, path string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		switch e.Action {
+		case "stderr":
+			e.Action = "output"
+		case "timeout":
+			e.Action = "fail"
+		}
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0664)
+}
+
+// writeLog writes the output of events to path, untruncated, in the order
+// it was printed, including that of reruns.
+func writeLog(events []event, path string) error {
+	var buf bytes.Buffer
+	for _, e := range events {
+		buf.WriteString(e.Output)
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0664)
+}
@@ -17,9 +17,14 @@ package bzltestutil
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestShouldWrap(t *testing.T) {
@@ -75,7 +80,7 @@ func TestMixedConverter(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error during test call %v", err.Error())
 	}
-	converter.Close()
+	converter.Close(false)
 	_, werr := events2xml(converter.GetOutput(), pkg)
 	if werr != nil {
 		if err != nil {
@@ -83,4 +88,184 @@ func TestMixedConverter(t *testing.T) {
 		}
 		t.Errorf("error while generating testreport: %s", werr)
 	}
-}
\ No newline at end of file
+}
+func TestRerunArgs(t *testing.T) {
+	var tests = []struct {
+		args       []string
+		testbridge string
+		preGo120   bool
+		failed     []string
+		want       []string
+	}{
+		{
+			args:   []string{"-test.v"},
+			failed: []string{"TestA", "TestB"},
+			want:   []string{"-test.v", "-test.run=^(TestA|TestB)$"},
+		}, {
+			args:   []string{"-test.run=TestA", "-test.v"},
+			failed: []string{"TestA"},
+			want:   []string{"-test.v", "-test.run=^(TestA)$"},
+		}, {
+			args:   []string{"-test.run", "Test/sub[/]x", "-test.count=2"},
+			failed: []string{"TestA"},
+			want:   []string{"-test.count=2", "-test.run=^(TestA)$/sub[/]x"},
+		}, {
+			args:       []string{},
+			testbridge: "Test(A|B/c)/sub",
+			failed:     []string{"TestB"},
+			want:       []string{"-test.run=^(TestB)$/sub"},
+		}, {
+			args:       []string{},
+			testbridge: "TestA/x,TestB/y,-TestC",
+			failed:     []string{"TestA", "TestB"},
+			want:       []string{"-test.run=^(TestA|TestB)$/x|^(TestA|TestB)$/y"},
+		}, {
+			args:   []string{},
+			failed: []string{"Test_a.b"},
+			want:   []string{"-test.run=^(Test_a\\.b)$"},
+		}, {
+			args:       []string{},
+			testbridge: "TestA/x",
+			preGo120:   true,
+			failed:     []string{"TestA"},
+			want:       []string{"-test.run=^(TestA)$/x"},
+		}, {
+			args:     []string{"-test.run=TestA/x|TestB/y"},
+			preGo120: true,
+			failed:   []string{"TestA", "TestB"},
+			want:     []string{"-test.run=^(TestA|TestB)$"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v", tt.args), func(t *testing.T) {
+			if tt.testbridge == "" {
+				os.Unsetenv("TESTBRIDGE_TEST_ONLY")
+			} else {
+				os.Setenv("TESTBRIDGE_TEST_ONLY", tt.testbridge)
+				defer os.Unsetenv("TESTBRIDGE_TEST_ONLY")
+			}
+			defer func(split bool) { splitsAlternatives = split }(splitsAlternatives)
+			splitsAlternatives = !tt.preGo120
+			got := rerunArgs(tt.args, tt.failed)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rerunArgs returned %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStackDumpDeadline(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		timeout string
+		want    time.Time
+	}{
+		{
+			timeout: "",
+			want:    time.Time{},
+		}, {
+			timeout: "invalid",
+			want:    time.Time{},
+		}, {
+			timeout: "10",
+			want:    start.Add(9 * time.Second),
+		}, {
+			timeout: "300",
+			want:    start.Add(290 * time.Second),
+		}, {
+			timeout: "100",
+			want:    start.Add(95 * time.Second),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timeout, func(t *testing.T) {
+			os.Setenv("TEST_TIMEOUT", tt.timeout)
+			defer os.Unsetenv("TEST_TIMEOUT")
+			if got := stackDumpDeadline(start); !got.Equal(tt.want) {
+				t.Errorf("stackDumpDeadline returned %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSONEvents(t *testing.T) {
+	elapsed := 0.5
+	events := []event{
+		{Action: "run", Package: "pkg", Test: "TestA"},
+		{Action: "output", Package: "pkg", Test: "TestA", Output: "=== RUN   TestA\n"},
+		{Action: "stderr", Package: "pkg", Test: "TestA", Output: "log line\n"},
+		{Action: "timeout", Package: "pkg", Test: "TestA"},
+		{Action: "fail", Package: "pkg", Elapsed: &elapsed},
+	}
+	path := filepath.Join(t.TempDir(), testEventsFile)
+	if err := writeJSONEvents(events, path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"Action":"run","Package":"pkg","Test":"TestA"}
+{"Action":"output","Package":"pkg","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Action":"output","Package":"pkg","Test":"TestA","Output":"log line\n"}
+{"Action":"fail","Package":"pkg","Test":"TestA"}
+{"Action":"fail","Package":"pkg","Elapsed":0.5}
+`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExitedNormally(t *testing.T) {
+	var tests = []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{
+			name:   "pass",
+			output: "=== RUN   TestA\n--- PASS: TestA (0.00s)\nPASS\n",
+			want:   true,
+		}, {
+			name:   "fail",
+			output: "=== RUN   TestA\n--- FAIL: TestA (0.00s)\nFAIL\n",
+			want:   true,
+		}, {
+			name:   "exit",
+			output: "=== RUN   TestA\n",
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			converter := NewMixedConverter("pkg", Timestamp)
+			io.WriteString(converter.stdoutConverter, tt.output)
+			converter.Close(false)
+			if got := exitedNormally(converter); got != tt.want {
+				t.Errorf("exitedNormally returned %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteLog(t *testing.T) {
+	events := []event{
+		{Action: "run", Test: "TestA"},
+		{Action: "output", Test: "TestA", Output: "=== RUN   TestA\n"},
+		{Action: "stderr", Test: "TestA", Output: strings.Repeat("x", 100) + "\n"},
+		{Action: "output", Test: "TestA", Output: "--- PASS: TestA (0.00s)\n"},
+		{Action: "pass", Test: "TestA"},
+	}
+	path := filepath.Join(t.TempDir(), testLogFile)
+	if err := writeLog(events, path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "=== RUN   TestA\n" + strings.Repeat("x", 100) + "\n--- PASS: TestA (0.00s)\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
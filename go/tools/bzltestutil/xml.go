@@ -17,7 +17,11 @@ package bzltestutil
 import (
 	"encoding/xml"
 	"fmt"
+	"os"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 type xmlTestSuites struct {
@@ -39,15 +43,38 @@ type xmlTestSuite struct {
 }
 
 type xmlTestCase struct {
-	XMLName   xml.Name    `xml:"testcase"`
-	Classname string      `xml:"classname,attr"`
-	Name      string      `xml:"name,attr"`
-	Time      string      `xml:"time,attr"`
-	Failure   *xmlMessage `xml:"failure,omitempty"`
-	Error     *xmlMessage `xml:"error,omitempty"`
-	Skipped   *xmlMessage `xml:"skipped,omitempty"`
-	Stdout    *xmlMessage `xml:"system-out,omitempty"`
-	Stderr    *xmlMessage `xml:"system-err,omitempty"`
+	XMLName   xml.Name `xml:"testcase"`
+	Classname string   `xml:"classname,attr"`
+	Name      string   `xml:"name,attr"`
+	Time      string   `xml:"time,attr"`
+	// Properties describe the test, like its parent test or the reason it
+	// was skipped, and hold the measurements of benchmarks.
+	Properties *xmlProperties `xml:"properties,omitempty"`
+	Failure    *xmlMessage    `xml:"failure,omitempty"`
+	Error      *xmlMessage    `xml:"error,omitempty"`
+	Skipped    *xmlMessage    `xml:"skipped,omitempty"`
+	// FlakyFailures are the failed attempts of a test that passed when it
+	// was rerun, and RerunFailures those of a test that never passed.
+	FlakyFailures []xmlRerun  `xml:"flakyFailure,omitempty"`
+	RerunFailures []xmlRerun  `xml:"rerunFailure,omitempty"`
+	Stdout        *xmlMessage `xml:"system-out,omitempty"`
+	Stderr        *xmlMessage `xml:"system-err,omitempty"`
+}
+
+type xmlRerun struct {
+	Message string      `xml:"message,attr,omitempty"`
+	Type    string      `xml:"type,attr,omitempty"`
+	Stdout  *xmlMessage `xml:"system-out,omitempty"`
+	Stderr  *xmlMessage `xml:"system-err,omitempty"`
+}
+
+type xmlProperties struct {
+	Properties []xmlProperty `xml:"property"`
+}
+
+type xmlProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
 }
 
 type xmlMessage struct {
@@ -57,15 +84,116 @@ type xmlMessage struct {
 }
 
 type testCase struct {
-	state    string
-	output   *Output
-	stderr   *Output
+	state string
+	// output and stderr are the whole output of the test. They are
+	// truncated when the test XML is written.
+	output   *strings.Builder
+	stderr   *strings.Builder
 	duration *float64
+	// attempts are the previous runs of the test that failed, if it was
+	// rerun.
+	attempts []*testCase
+	// benchmarks are the results of the runs of a benchmark.
+	benchmarks []*benchmarkResult
+	// crashers are the failing inputs found by a fuzz target.
+	crashers []crasher
+}
+
+// testSuite holds the results of the tests of a test binary.
+type testSuite struct {
+	cases    map[string]*testCase
+	duration *float64
+	// stdout and stderr are the output of the test binary outside of tests.
+	stdout   *strings.Builder
+	stderr   *strings.Builder
+	timedOut bool
+	// benchmarks are the results of all benchmarks, in the order they ran,
+	// and benchmarkConfig the configuration lines printed before them.
+	benchmarks      []*benchmarkResult
+	benchmarkConfig []string
+}
+
+const (
+	// caseOutputLimitEnv is the environment variable setting how many bytes
+	// of the start and of the end of each output of a test case are kept in
+	// the test XML. The output in between is replaced by a marker with its
+	// size.
+	caseOutputLimitEnv = "GO_TEST_CASE_OUTPUT_LIMIT"
+	// suiteOutputLimitEnv is the environment variable setting how many
+	// bytes of output are kept in the test XML in total, for the test
+	// binary outside of tests and for all test cases and their attempts.
+	// Outputs are truncated further to share it, see limitOutputs.
+	suiteOutputLimitEnv = "GO_TEST_SUITE_OUTPUT_LIMIT"
+
+	// defaultSuiteOutputLimit is the default value of suiteOutputLimitEnv.
+	defaultSuiteOutputLimit uint64 = 1024 * 1024
+)
+
+// outputLimit returns the limit set by the environment variable env, or
+// def if it isn't set or is invalid.
+func outputLimit(env string, def uint64) uint64 {
+	v, ok := os.LookupEnv(env)
+	if !ok {
+		return def
+	}
+	limit, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || limit == 0 {
+		fmt.Fprintf(os.Stderr, "invalid value for %s: %q, keeping %d bytes of output\n", env, v, def)
+		return def
+	}
+	return limit
+}
+
+// limitOutputs returns outputs truncated so that each one keeps at most
+// limits[i] bytes of its start and of its end, or all of it if limits[i] is
+// 0, and they keep at most total bytes altogether, not counting the markers
+// replacing what was skipped. The total is shared so that outputs smaller
+// than an equal share are kept whole, and the others get the same share of
+// what remains.
+func limitOutputs(outputs []string, limits []uint64, total uint64) []string {
+	sizes := make([]uint64, len(outputs))
+	order := make([]int, len(outputs))
+	for i, output := range outputs {
+		sizes[i] = uint64(len(output))
+		if limits[i] > 0 && sizes[i] > 2*limits[i] {
+			sizes[i] = 2 * limits[i]
+		}
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return sizes[order[i]] < sizes[order[j]] })
+	remaining := total
+	for n, i := range order {
+		if share := remaining / uint64(len(order)-n); sizes[i] > share {
+			sizes[i] = share
+		}
+		remaining -= sizes[i]
+	}
+
+	limited := make([]string, len(outputs))
+	for i, output := range outputs {
+		if uint64(len(output)) <= sizes[i] {
+			limited[i] = output
+			continue
+		}
+		o := NewOutput(sizes[i] / 2)
+		o.WriteString(output)
+		limited[i] = o.String()
+	}
+	return limited
 }
 
 // events2xml converts test2json's output into an xml output readable by Bazel.
 // http://windyroad.com.au/dl/Open%20Source/JUnit.xsd
 func events2xml(events []event, pkgName string) ([]byte, error) {
+	return suite2xml(parseEvents(events), pkgName)
+}
+
+func suite2xml(suite *testSuite, pkgName string) ([]byte, error) {
+	return xml.MarshalIndent(toXML(pkgName, suite), "", "\t")
+}
+
+// parseEvents collects the results of the tests from test2json's output.
+func parseEvents(events []event) *testSuite {
 	var pkgDuration *float64
 	testcases := make(map[string]*testCase)
 	testCaseByName := func(name string) *testCase {
@@ -74,13 +202,16 @@ func events2xml(events []event, pkgName string) ([]byte, error) {
 		}
 		if _, ok := testcases[name]; !ok {
 			testcases[name] = &testCase{
-				output: NewOutput(defaultOutputLimit),
-				stderr: NewOutput(defaultOutputLimit),
+				output: &strings.Builder{},
+				stderr: &strings.Builder{},
 			}
 		}
 		return testcases[name]
 	}
-	var suiteStdout, suiteStderr string
+	suiteStdout, suiteStderr := &strings.Builder{}, &strings.Builder{}
+	// stdout is the whole standard output, since benchmark results may be
+	// attributed to the test that ran before.
+	var stdout strings.Builder
 	suiteTimedOut := false
 	for _, e := range events {
 		switch s := e.Action; s {
@@ -89,16 +220,17 @@ func events2xml(events []event, pkgName string) ([]byte, error) {
 				c.state = s
 			}
 		case "output":
+			stdout.WriteString(e.Output)
 			if c := testCaseByName(e.Test); c != nil {
 				c.output.WriteString(e.Output)
 			} else {
-				suiteStdout += e.Output
+				suiteStdout.WriteString(e.Output)
 			}
 		case "stderr":
 			if c := testCaseByName(e.Test); c != nil {
 				c.stderr.WriteString(e.Output)
 			} else {
-				suiteStderr += e.Output
+				suiteStderr.WriteString(e.Output)
 			}
 		case "skip":
 			if c := testCaseByName(e.Test); c != nil {
@@ -128,46 +260,144 @@ func events2xml(events []event, pkgName string) ([]byte, error) {
 			} else {
 				pkgDuration = e.Elapsed
 			}
+		case "bench":
+			// Reported when a benchmark logs, which doesn't make it fail.
+			if c := testCaseByName(e.Test); c != nil && c.state == "" {
+				c.state = "pass"
+			}
 		}
 	}
 
-	return xml.MarshalIndent(toXML(pkgName, pkgDuration, testcases, suiteStdout, suiteStderr, suiteTimedOut), "", "\t")
+	benchmarkConfig, benchmarks := parseBenchmarks(stdout.String())
+	for _, r := range benchmarks {
+		c := testCaseByName(r.name)
+		if c.state == "" {
+			c.state = "pass"
+		}
+		c.benchmarks = append(c.benchmarks, r)
+		for _, m := range r.metrics {
+			if m.unit == "ns/op" {
+				d := float64(r.iterations) * m.value / 1e9
+				if c.duration != nil {
+					d += *c.duration
+				}
+				c.duration = &d
+			}
+		}
+	}
+
+	return &testSuite{
+		cases:           testcases,
+		duration:        pkgDuration,
+		stdout:          suiteStdout,
+		stderr:          suiteStderr,
+		timedOut:        suiteTimedOut,
+		benchmarks:      benchmarks,
+		benchmarkConfig: benchmarkConfig,
+	}
 }
 
-func toXML(pkgName string, pkgDuration *float64, testcases map[string]*testCase, suiteStdout string, suiteStderr string, suiteTimedOut bool) *xmlTestSuites {
-	cases := make([]string, 0, len(testcases))
-	for k := range testcases {
+// failedTests returns the names of the top-level tests that failed, which
+// also includes the tests whose subtests failed.
+func (s *testSuite) failedTests() []string {
+	var names []string
+	for name, c := range s.cases {
+		if c.state == "fail" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addRerun replaces the results of tests and of their subtests with those
+// of rerun, a run of the same test binary limited to tests. The previous
+// results are kept as failed attempts.
+func (s *testSuite) addRerun(rerun *testSuite, tests []string) {
+	rerunTests := make(map[string]bool, len(tests))
+	for _, name := range tests {
+		rerunTests[name] = true
+	}
+	for name, c := range s.cases {
+		if rerunTests[strings.SplitN(name, "/", 2)[0]] {
+			delete(s.cases, name)
+			if newCase, ok := rerun.cases[name]; ok {
+				newCase.attempts = append(c.attempts, c)
+			}
+		}
+	}
+	for name, c := range rerun.cases {
+		s.cases[name] = c
+	}
+	if rerun.duration != nil {
+		duration := *rerun.duration
+		if s.duration != nil {
+			duration += *s.duration
+		}
+		s.duration = &duration
+	}
+	s.stdout.WriteString(rerun.stdout.String())
+	s.stderr.WriteString(rerun.stderr.String())
+	s.timedOut = rerun.timedOut
+}
+
+func toXML(pkgName string, testSuite *testSuite) *xmlTestSuites {
+	cases := make([]string, 0, len(testSuite.cases))
+	for k := range testSuite.cases {
 		cases = append(cases, k)
 	}
 	sort.Strings(cases)
+
+	// Truncate all outputs at once, so that they share the limit of the
+	// suite, and take them in the same order below.
+	caseLimit := outputLimit(caseOutputLimitEnv, defaultOutputLimit)
+	outputs := []string{testSuite.stdout.String(), testSuite.stderr.String()}
+	limits := []uint64{0, 0}
+	for _, name := range cases {
+		c := testSuite.cases[name]
+		for _, run := range append([]*testCase{c}, c.attempts...) {
+			outputs = append(outputs, run.output.String(), run.stderr.String())
+			limits = append(limits, caseLimit, caseLimit)
+		}
+	}
+	outputs = limitOutputs(outputs, limits, outputLimit(suiteOutputLimitEnv, defaultSuiteOutputLimit))
+	nextOutput := func() string {
+		output := outputs[0]
+		outputs = outputs[1:]
+		return output
+	}
+
 	suite := xmlTestSuite{
 		Name: pkgName,
 		Stdout: &xmlMessage{
-			Contents: suiteStdout,
+			Contents: nextOutput(),
 		},
 		Stderr: &xmlMessage{
-			Contents: suiteStderr,
+			Contents: nextOutput(),
 		},
 	}
-	if pkgDuration != nil {
-		suite.Time = fmt.Sprintf("%.3f", *pkgDuration)
+	if testSuite.duration != nil {
+		suite.Time = fmt.Sprintf("%.3f", *testSuite.duration)
 	}
 	for _, name := range cases {
-		c := testcases[name]
+		c := testSuite.cases[name]
 		suite.Tests++
 		newCase := xmlTestCase{
 			Name:      name,
 			Classname: pkgName,
 			Stdout: &xmlMessage{
-				Contents: c.output.String(),
+				Contents: nextOutput(),
 			},
 			Stderr: &xmlMessage{
-				Contents: c.stderr.String(),
+				Contents: nextOutput(),
 			},
 		}
 		if c.duration != nil {
 			newCase.Time = fmt.Sprintf("%.3f", *c.duration)
 		}
+		if props := caseProperties(name, c); len(props) > 0 {
+			newCase.Properties = &xmlProperties{Properties: props}
+		}
 		switch c.state {
 		case "skip":
 			suite.Skipped++
@@ -176,8 +406,18 @@ func toXML(pkgName string, pkgDuration *float64, testcases map[string]*testCase,
 			}
 		case "fail":
 			suite.Failures++
+			message, location := failureMessage(c.output.String())
 			newCase.Failure = &xmlMessage{
-				Message: "Failed",
+				Message: message,
+				Type:    location,
+			}
+			if len(c.crashers) > 0 {
+				newCase.Failure.Contents = crasherReport(c.crashers)
+				for _, crasher := range c.crashers {
+					// Attachments are listed in the output, like the
+					// JUnit Attachments plugin of Jenkins expects.
+					newCase.Stdout.Contents += fmt.Sprintf("[[ATTACHMENT|%s]]\n", crasher.path)
+				}
 			}
 		case "timeout":
 			suite.Failures++
@@ -187,7 +427,7 @@ func toXML(pkgName string, pkgDuration *float64, testcases map[string]*testCase,
 		case "pass":
 			break
 		default:
-			if suiteTimedOut {
+			if testSuite.timedOut {
 				suite.Skipped++
 				newCase.Skipped = &xmlMessage{
 					Message: "Test from this suite timed out, execution aborted",
@@ -201,7 +441,71 @@ func toXML(pkgName string, pkgDuration *float64, testcases map[string]*testCase,
 				//panic("No pass/skip/fail/timeout event found for test")
 			}
 		}
+		for _, attempt := range c.attempts {
+			message, location := failureMessage(attempt.output.String())
+			rerun := xmlRerun{
+				Message: message,
+				Type:    location,
+				Stdout: &xmlMessage{
+					Contents: nextOutput(),
+				},
+				Stderr: &xmlMessage{
+					Contents: nextOutput(),
+				},
+			}
+			if c.state == "pass" {
+				newCase.FlakyFailures = append(newCase.FlakyFailures, rerun)
+			} else {
+				newCase.RerunFailures = append(newCase.RerunFailures, rerun)
+			}
+		}
 		suite.TestCases = append(suite.TestCases, newCase)
 	}
 	return &xmlTestSuites{Suites: []xmlTestSuite{suite}}
 }
+
+// logLineRegexp matches the lines logged by tests with t.Log, t.Error and
+// the like, with their location, like "    foo_test.go:12: message".
+var logLineRegexp = regexp.MustCompile(`(?m)^\s*([^\s:]+\.go:\d+): (.*)$`)
+
+// panicRegexp matches the first line printed when a test panics.
+var panicRegexp = regexp.MustCompile(`(?m)^panic: (.*)$`)
+
+// failureMessage returns the message and location of the first line logged
+// by a failed test, or of the panic that made it fail, from its output. Only
+// the first line of the message is kept. It returns "Failed" and no
+// location if there is neither, like for a test whose subtests failed.
+func failureMessage(output string) (message, location string) {
+	logLine := logLineRegexp.FindStringSubmatchIndex(output)
+	panicLine := panicRegexp.FindStringSubmatchIndex(output)
+	switch {
+	case panicLine != nil && (logLine == nil || panicLine[0] < logLine[0]):
+		return output[panicLine[0]:panicLine[1]], "panic"
+	case logLine != nil:
+		return output[logLine[4]:logLine[5]], output[logLine[2]:logLine[3]]
+	}
+	return "Failed", ""
+}
+
+// caseProperties returns the properties of the test case of the test name:
+// its parent if it's a subtest, its elapsed time in seconds, unrounded
+// unlike the time attribute, the reason it was skipped, which is the last
+// line it logged, and the measurements of benchmarks.
+func caseProperties(name string, c *testCase) []xmlProperty {
+	var props []xmlProperty
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		props = append(props, xmlProperty{Name: "parent", Value: name[:i]})
+	}
+	if c.duration != nil {
+		props = append(props, xmlProperty{Name: "elapsed", Value: strconv.FormatFloat(*c.duration, 'f', -1, 64)})
+	}
+	if c.state == "skip" {
+		if lines := logLineRegexp.FindAllStringSubmatch(c.output.String(), -1); len(lines) > 0 {
+			props = append(props, xmlProperty{Name: "skip_reason", Value: lines[len(lines)-1][2]})
+		}
+	}
+	if len(c.benchmarks) > 0 {
+		props = append(props, benchmarkProperties(c.benchmarks)...)
+	}
+	return props
+}
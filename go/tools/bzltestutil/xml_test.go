@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -84,3 +85,164 @@ func TestJSON2XML(t *testing.T) {
 		})
 	}
 }
+
+func TestRerunXML(t *testing.T) {
+	firstRun := []event{
+		{Action: "run", Test: "TestFlaky"},
+		{Action: "output", Test: "TestFlaky", Output: "flaky failure\n"},
+		{Action: "fail", Test: "TestFlaky"},
+		{Action: "run", Test: "TestBroken"},
+		{Action: "run", Test: "TestBroken/sub"},
+		{Action: "output", Test: "TestBroken/sub", Output: "broken\n"},
+		{Action: "fail", Test: "TestBroken/sub"},
+		{Action: "fail", Test: "TestBroken"},
+		{Action: "run", Test: "TestPass"},
+		{Action: "pass", Test: "TestPass"},
+		{Action: "output", Output: "FAIL\n"},
+		{Action: "fail"},
+	}
+	rerun := []event{
+		{Action: "run", Test: "TestFlaky"},
+		{Action: "pass", Test: "TestFlaky"},
+		{Action: "run", Test: "TestBroken"},
+		{Action: "run", Test: "TestBroken/sub"},
+		{Action: "output", Test: "TestBroken/sub", Output: "still broken\n"},
+		{Action: "fail", Test: "TestBroken/sub"},
+		{Action: "fail", Test: "TestBroken"},
+		{Action: "output", Output: "FAIL\n"},
+		{Action: "fail"},
+	}
+
+	suite := parseEvents(firstRun)
+	failed := suite.failedTests()
+	if want := []string{"TestBroken", "TestFlaky"}; !reflect.DeepEqual(failed, want) {
+		t.Fatalf("got failed tests %q, want %q", failed, want)
+	}
+	suite.addRerun(parseEvents(rerun), failed)
+
+	result := toXML("pkg/testing", suite).Suites[0]
+	if result.Failures != 2 || result.Tests != 4 {
+		t.Errorf("got %d failures in %d tests, want 2 failures in 4 tests", result.Failures, result.Tests)
+	}
+	cases := map[string]xmlTestCase{}
+	for _, c := range result.TestCases {
+		cases[c.Name] = c
+	}
+	if c := cases["TestFlaky"]; c.Failure != nil || len(c.FlakyFailures) != 1 || c.FlakyFailures[0].Stdout.Contents != "flaky failure\n" {
+		t.Errorf("TestFlaky should pass with a flaky failure, got %+v", c)
+	}
+	if c := cases["TestBroken/sub"]; c.Failure == nil || len(c.RerunFailures) != 1 || c.RerunFailures[0].Stdout.Contents != "broken\n" {
+		t.Errorf("TestBroken/sub should fail with a rerun failure, got %+v", c)
+	}
+	if c := cases["TestPass"]; c.Failure != nil || len(c.FlakyFailures) != 0 {
+		t.Errorf("TestPass should pass, got %+v", c)
+	}
+	if want := "FAIL\nFAIL\n"; result.Stdout.Contents != want {
+		t.Errorf("got suite output %q, want %q", result.Stdout.Contents, want)
+	}
+}
+
+func TestFailureMessage(t *testing.T) {
+	var tests = []struct {
+		output, message, location string
+	}{
+		{
+			output:   "=== RUN   TestFail\n--- FAIL: TestFail (0.00s)\n    foo_test.go:23: Not working\n    foo_test.go:24: Still not working\n",
+			message:  "Not working",
+			location: "foo_test.go:23",
+		}, {
+			output:   "=== RUN   TestFail\n    foo_test.go:23: got:\n        1\n--- FAIL: TestFail (0.00s)\n",
+			message:  "got:",
+			location: "foo_test.go:23",
+		}, {
+			output:   "=== RUN   TestPanic\n--- FAIL: TestPanic (0.00s)\npanic: oops [recovered]\n\tpanic: oops\n\ngoroutine 6 [running]:\n",
+			message:  "panic: oops [recovered]",
+			location: "panic",
+		}, {
+			output:  "=== RUN   TestSubtests\n--- FAIL: TestSubtests (0.02s)\n",
+			message: "Failed",
+		},
+	}
+	for _, tt := range tests {
+		message, location := failureMessage(tt.output)
+		if message != tt.message || location != tt.location {
+			t.Errorf("failureMessage(%q) = %q, %q, expected %q, %q", tt.output, message, location, tt.message, tt.location)
+		}
+	}
+}
+
+func TestCaseProperties(t *testing.T) {
+	suite := parseEvents([]event{
+		{Action: "run", Test: "TestA"},
+		{Action: "run", Test: "TestA/sub"},
+		{Action: "output", Test: "TestA/sub", Output: "    --- SKIP: TestA/sub (0.00s)\n        a_test.go:12: setting up\n        a_test.go:13: needs a database\n"},
+		{Action: "skip", Test: "TestA/sub", Elapsed: floatPtr(0)},
+		{Action: "pass", Test: "TestA", Elapsed: floatPtr(0.25)},
+		{Action: "pass"},
+	})
+	cases := map[string]xmlTestCase{}
+	for _, c := range toXML("pkg/testing", suite).Suites[0].TestCases {
+		cases[c.Name] = c
+	}
+	want := map[string]*xmlProperties{
+		"TestA": {Properties: []xmlProperty{
+			{Name: "elapsed", Value: "0.25"},
+		}},
+		"TestA/sub": {Properties: []xmlProperty{
+			{Name: "parent", Value: "TestA"},
+			{Name: "elapsed", Value: "0"},
+			{Name: "skip_reason", Value: "needs a database"},
+		}},
+	}
+	for name, props := range want {
+		if got := cases[name].Properties; !reflect.DeepEqual(got, props) {
+			t.Errorf("got properties %+v for %s, expected %+v", got, name, props)
+		}
+	}
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestOutputLimits(t *testing.T) {
+	os.Setenv(caseOutputLimitEnv, "10")
+	defer os.Unsetenv(caseOutputLimitEnv)
+	os.Setenv(suiteOutputLimitEnv, "60")
+	defer os.Unsetenv(suiteOutputLimitEnv)
+
+	suite := parseEvents([]event{
+		{Action: "run", Test: "TestA"},
+		{Action: "output", Test: "TestA", Output: "0123456789\n" + strings.Repeat("x", 100) + "\n0123456789\n"},
+		{Action: "pass", Test: "TestA"},
+		{Action: "output", Output: "PASS\n"},
+		{Action: "output", Output: strings.Repeat("y", 50) + "\n"},
+		{Action: "output", Output: "ok\n"},
+		{Action: "pass"},
+	})
+	result := toXML("pkg/testing", suite).Suites[0]
+	// The output of TestA is limited to 10 bytes at each end, and the suite
+	// output gets the 40 bytes left of the 60 bytes of the suite.
+	if want := "0123456789\n... Too big output (total: 123 bytes, skipped: 103 bytes) ...\n123456789\n"; result.TestCases[0].Stdout.Contents != want {
+		t.Errorf("got test case output %q, expected %q", result.TestCases[0].Stdout.Contents, want)
+	}
+	if want := "PASS\n" + strings.Repeat("y", 15) + "\n... Too big output (total: 59 bytes, skipped: 19 bytes) ...\n" + strings.Repeat("y", 16) + "\nok\n"; result.Stdout.Contents != want {
+		t.Errorf("got suite output %q, expected %q", result.Stdout.Contents, want)
+	}
+}
+
+func TestLimitOutputs(t *testing.T) {
+	outputs := []string{"", "short", strings.Repeat("a", 100), strings.Repeat("b", 100)}
+	got := limitOutputs(outputs, []uint64{0, 0, 0, 30}, 50)
+	// "short" is kept whole, and the others share the 45 bytes left, up to
+	// their own limit.
+	want := []string{
+		"",
+		"short",
+		strings.Repeat("a", 11) + "\n... Too big output (total: 100 bytes, skipped: 78 bytes) ...\n" + strings.Repeat("a", 11),
+		strings.Repeat("b", 11) + "\n... Too big output (total: 100 bytes, skipped: 78 bytes) ...\n" + strings.Repeat("b", 11),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got outputs %q, expected %q", got, want)
+	}
+}
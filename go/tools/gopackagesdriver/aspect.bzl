@@ -35,10 +35,20 @@ def _file_path(f):
         prefix = "__BAZEL_OUTPUT_BASE__"
     return paths.join(prefix, f.path)
 
-def _go_archive_to_pkg(archive):
+def _build_config(mode):
+    # The configuration the package was built in, which the driver uses to
+    # filter files and to compute type sizes.
     return struct(
-        ID = str(archive.data.label),
-        PkgPath = archive.data.importpath,
+        GOOS = mode.goos,
+        GOARCH = mode.goarch,
+        Tags = mode.tags,
+        CgoEnabled = not mode.pure,
+    )
+
+def _go_archive_to_pkg(archive, id = None, pkg_path = None, for_test = None):
+    pkg = dict(
+        ID = id or str(archive.data.label),
+        PkgPath = pkg_path or archive.data.importpath,
         ExportFile = _file_path(archive.data.export_file),
         GoFiles = [
             _file_path(src)
@@ -48,13 +58,109 @@ def _go_archive_to_pkg(archive):
             _file_path(src)
             for src in archive.data.srcs
         ],
+        Config = _build_config(archive.source.mode),
     )
+    if for_test:
+        pkg["ForTest"] = for_test
+    if archive.data._cgo_srcs:
+        # The Go files generated by cgo, which the driver reports as
+        # CompiledGoFiles.
+        pkg["CgoSrcsDir"] = _file_path(archive.data._cgo_srcs)
+    if archive.data._embedcfg:
+        # The //go:embed patterns and the files they match, which the driver
+        # reports as EmbedPatterns and EmbedFiles.
+        pkg["EmbedCfg"] = _file_path(archive.data._embedcfg)
+    if archive.data.label.workspace_name:
+        # The external repository of the package, which the driver maps to
+        # a module.
+        pkg["Repo"] = archive.data.label.workspace_name
+    return struct(**pkg)
 
 def _make_pkg_json(ctx, archive, pkg_info):
     pkg_json_file = ctx.actions.declare_file(archive.data.name + ".pkg.json")
     ctx.actions.write(pkg_json_file, content = pkg_info.to_json())
     return pkg_json_file
 
+def _go_test_pkgs(target, ctx):
+    """Returns the package JSON files, sources and export files of a go_test.
+
+    go_test compiles the package under test together with its internal tests,
+    the external test package, and a generated main package; they are all
+    labeled with the test's label. Like "go list -test", give them distinct
+    IDs: "<library> [<test>.test]", "<library>_test [<test>.test]" and
+    "<test>.test", where <library> is the label of the embedded library under
+    test (or the test itself) and <test> is the label of the test. The driver
+    creates test variants of dependencies that go_test recompiles.
+    """
+    test_archive = target[GoArchive]
+    test_id = str(target.label) + ".test"
+
+    # The GoArchive of the test is the generated main package. Consume the
+    # archives compiled for the test via GoArchive.direct so the test sources
+    # are there. Skip direct dependencies that are defined as deps, and use the
+    # importpath to find which.
+    deps_importpaths = [
+        dep[GoArchive].data.importpath
+        for dep in ctx.rule.attr.deps
+        if GoArchive in dep
+    ]
+    direct = [
+        archive
+        for archive in test_archive.direct
+        if archive.data.importpath not in deps_importpaths
+    ]
+    test_importpaths = [
+        archive.data.importpath
+        for archive in direct
+        if archive.data.label == target.label
+    ]
+
+    # The package under test is the embedded library, or else the internal
+    # test archive, whether or not there is an external test package.
+    pkg_path = ""
+    library_id = str(target.label)
+    for dep in ctx.rule.attr.embed:
+        if GoArchive in dep:
+            pkg_path = dep[GoArchive].data.importpath
+            library_id = str(dep.label)
+            break
+    if not pkg_path:
+        for importpath in test_importpaths:
+            if importpath + "_test" in test_importpaths or not importpath.endswith("_test"):
+                pkg_path = importpath
+                break
+
+    pkg_json_files = []
+    compiled_go_files = []
+    export_files = []
+    cgo_srcs = []
+    embedcfgs = []
+    for archive in [test_archive] + direct:
+        if archive == test_archive:
+            pkg = _go_archive_to_pkg(archive, id = test_id, pkg_path = pkg_path + ".test")
+        elif archive.data.label == target.label and archive.data.importpath == pkg_path:
+            pkg = _go_archive_to_pkg(
+                archive,
+                id = "%s [%s]" % (library_id, test_id),
+                for_test = pkg_path,
+            )
+        elif archive.data.label == target.label and archive.data.importpath == pkg_path + "_test":
+            pkg = _go_archive_to_pkg(
+                archive,
+                id = "%s_test [%s]" % (library_id, test_id),
+                for_test = pkg_path,
+            )
+        else:
+            pkg = _go_archive_to_pkg(archive)
+        pkg_json_files.append(_make_pkg_json(ctx, archive, pkg))
+        compiled_go_files.extend(archive.source.srcs)
+        export_files.append(archive.data.export_file)
+        if archive.data._cgo_srcs:
+            cgo_srcs.append(archive.data._cgo_srcs)
+        if archive.data._embedcfg:
+            embedcfgs.append(archive.data._embedcfg)
+    return pkg_json_files, compiled_go_files, export_files, cgo_srcs, embedcfgs
+
 def _go_pkg_info_aspect_impl(target, ctx):
     # Fetch the stdlib JSON file from the inner most target
     stdlib_json_file = None
@@ -62,6 +168,8 @@ def _go_pkg_info_aspect_impl(target, ctx):
     deps_transitive_json_file = []
     deps_transitive_export_file = []
     deps_transitive_compiled_go_files = []
+    deps_transitive_cgo_srcs = []
+    deps_transitive_embedcfg = []
 
     for attr in ["deps", "embed"]:
         for dep in getattr(ctx.rule.attr, attr, []):
@@ -71,12 +179,16 @@ def _go_pkg_info_aspect_impl(target, ctx):
                     deps_transitive_json_file.append(pkg_info.transitive_json_file)
                     deps_transitive_export_file.append(pkg_info.transitive_export_file)
                     deps_transitive_compiled_go_files.append(pkg_info.transitive_compiled_go_files)
+                    deps_transitive_cgo_srcs.append(pkg_info.transitive_cgo_srcs)
+                    deps_transitive_embedcfg.append(pkg_info.transitive_embedcfg)
                 elif attr == "embed":
                     # If deps are embedded, do not gather their json or export_file since they
                     # are included in the current target, but do gather their deps'.
                     deps_transitive_json_file.append(pkg_info.deps_transitive_json_file)
                     deps_transitive_export_file.append(pkg_info.deps_transitive_export_file)
                     deps_transitive_compiled_go_files.append(pkg_info.deps_transitive_compiled_go_files)
+                    deps_transitive_cgo_srcs.append(pkg_info.deps_transitive_cgo_srcs)
+                    deps_transitive_embedcfg.append(pkg_info.deps_transitive_embedcfg)
 
                 # Fetch the stdlib json from the first dependency
                 if not stdlib_json_file:
@@ -85,32 +197,22 @@ def _go_pkg_info_aspect_impl(target, ctx):
     pkg_json_files = []
     compiled_go_files = []
     export_files = []
+    cgo_srcs = []
+    embedcfgs = []
 
-    if GoArchive in target:
+    if GoArchive in target and ctx.rule.kind == "go_test":
+        pkg_json_files, compiled_go_files, export_files, cgo_srcs, embedcfgs = _go_test_pkgs(target, ctx)
+    elif GoArchive in target:
         archive = target[GoArchive]
         compiled_go_files.extend(archive.source.srcs)
         export_files.append(archive.data.export_file)
+        if archive.data._cgo_srcs:
+            cgo_srcs.append(archive.data._cgo_srcs)
+        if archive.data._embedcfg:
+            embedcfgs.append(archive.data._embedcfg)
         pkg = _go_archive_to_pkg(archive)
         pkg_json_files.append(_make_pkg_json(ctx, archive, pkg))
 
-        # if the rule is a test, we need to get the embedded go_library with the current
-        # test's sources. For that, consume the dependency via GoArchive.direct so that
-        # the test source files are there. Then, create the pkg json file directly. Only
-        # do that for direct dependencies that are not defined as deps, and use the
-        # importpath to find which.
-        if ctx.rule.kind == "go_test":
-            deps_targets = [
-                dep[GoArchive].data.importpath
-                for dep in ctx.rule.attr.deps
-                if GoArchive in dep
-            ]
-            for archive in target[GoArchive].direct:
-                if archive.data.importpath not in deps_targets:
-                    pkg = _go_archive_to_pkg(archive)
-                    pkg_json_files.append(_make_pkg_json(ctx, archive, pkg))
-                    compiled_go_files.extend(archive.source.srcs)
-                    export_files.append(archive.data.export_file)
-
     # If there was no stdlib json in any dependencies, fetch it from the
     # current go_ node.
     if not stdlib_json_file:
@@ -139,6 +241,20 @@ def _go_pkg_info_aspect_impl(target, ctx):
         deps_transitive_export_file = depset(
             transitive = deps_transitive_export_file,
         ),
+        transitive_cgo_srcs = depset(
+            direct = cgo_srcs,
+            transitive = deps_transitive_cgo_srcs,
+        ),
+        deps_transitive_cgo_srcs = depset(
+            transitive = deps_transitive_cgo_srcs,
+        ),
+        transitive_embedcfg = depset(
+            direct = embedcfgs,
+            transitive = deps_transitive_embedcfg,
+        ),
+        deps_transitive_embedcfg = depset(
+            transitive = deps_transitive_embedcfg,
+        ),
     )
 
     return [
@@ -147,6 +263,8 @@ def _go_pkg_info_aspect_impl(target, ctx):
             go_pkg_driver_json_file = pkg_info.transitive_json_file,
             go_pkg_driver_srcs = pkg_info.transitive_compiled_go_files,
             go_pkg_driver_export_file = pkg_info.transitive_export_file,
+            go_pkg_driver_cgo_srcs = pkg_info.transitive_cgo_srcs,
+            go_pkg_driver_embedcfg = pkg_info.transitive_embedcfg,
             go_pkg_driver_stdlib_json_file = depset([pkg_info.stdlib_json_file] if pkg_info.stdlib_json_file else []),
         ),
     ]
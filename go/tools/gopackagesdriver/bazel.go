@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -33,14 +34,44 @@ const (
 	toolTag = "gopackagesdriver"
 )
 
-type Bazel struct {
+// Bazel runs the Bazel commands the driver needs. It is an interface so that
+// tests can replay recorded outputs instead of running Bazel.
+type Bazel interface {
+	// Build runs "bazel build" with args and returns the files reported in
+	// the Build Event Protocol. If some targets fail to build, it returns
+	// the files that were built along with a *BazelError.
+	Build(ctx context.Context, args ...string) ([]string, error)
+	// Query runs "bazel query" with args and returns the lines it printed.
+	Query(ctx context.Context, args ...string) ([]string, error)
+	WorkspaceRoot() string
+	ExecutionRoot() string
+	OutputBase() string
+}
+
+// bazelClient runs the Bazel binary.
+type bazelClient struct {
 	bazelBin      string
 	workspaceRoot string
 	info          map[string]string
 }
 
-// Minimal BEP structs to access the build outputs
-type BEPNamedSet struct {
+// Minimal BEP structs to access the build outputs and the targets that
+// failed
+type BEPEvent struct {
+	ID struct {
+		TargetCompleted *struct {
+			Label string `json:"label"`
+		} `json:"targetCompleted"`
+		TargetConfigured *struct {
+			Label string `json:"label"`
+		} `json:"targetConfigured"`
+	} `json:"id"`
+	Completed *struct {
+		Success bool `json:"success"`
+	} `json:"completed"`
+	Aborted *struct {
+		Reason string `json:"reason"`
+	} `json:"aborted"`
 	NamedSetOfFiles *struct {
 		Files []struct {
 			Name string `json:"name"`
@@ -49,8 +80,77 @@ type BEPNamedSet struct {
 	} `json:"namedSetOfFiles"`
 }
 
-func NewBazel(ctx context.Context, bazelBin, workspaceRoot string) (*Bazel, error) {
-	b := &Bazel{
+// failedLabel returns the label of the target whose failure the event
+// reports, or "" if it doesn't report one.
+func (e *BEPEvent) failedLabel() string {
+	switch {
+	case e.ID.TargetCompleted != nil && (e.Aborted != nil || e.Completed != nil && !e.Completed.Success):
+		return e.ID.TargetCompleted.Label
+	case e.ID.TargetConfigured != nil && e.Aborted != nil:
+		return e.ID.TargetConfigured.Label
+	}
+	return ""
+}
+
+// maxErrorSummaryLines is the number of lines of Bazel's output kept in a
+// BazelError.
+const maxErrorSummaryLines = 10
+
+// BazelError is returned when a Bazel command fails. Build returns it along
+// with the partial results when some targets failed to build.
+type BazelError struct {
+	Command string
+	// Summary holds the errors Bazel printed, or the last lines of its output
+	// if it didn't print any.
+	Summary []string
+	// Targets are the labels of the targets that failed.
+	Targets []string
+	Err     error
+}
+
+func (e *BazelError) Error() string {
+	msg := "bazel " + e.Command + " failed"
+	if len(e.Targets) > 0 {
+		msg += " for " + strings.Join(e.Targets, ", ")
+	}
+	if len(e.Summary) == 0 {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg + ":\n" + strings.Join(e.Summary, "\n")
+}
+
+func (e *BazelError) Unwrap() error {
+	return e.Err
+}
+
+// errorSummary returns the lines of Bazel's stderr that report errors, or
+// its last lines if none do.
+func errorSummary(stderr string) []string {
+	var lines, errors []string
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "ERROR:") {
+			errors = append(errors, line)
+		}
+	}
+	if len(errors) == 0 {
+		errors = lines
+		if len(errors) > maxErrorSummaryLines {
+			errors = errors[len(errors)-maxErrorSummaryLines:]
+		}
+	}
+	if len(errors) > maxErrorSummaryLines {
+		errors = append(errors[:maxErrorSummaryLines], fmt.Sprintf("(%d more errors)", len(errors)-maxErrorSummaryLines))
+	}
+	return errors
+}
+
+func NewBazel(ctx context.Context, bazelBin, workspaceRoot string) (Bazel, error) {
+	b := &bazelClient{
 		bazelBin:      bazelBin,
 		workspaceRoot: workspaceRoot,
 	}
@@ -60,7 +160,7 @@ func NewBazel(ctx context.Context, bazelBin, workspaceRoot string) (*Bazel, erro
 	return b, nil
 }
 
-func (b *Bazel) fillInfo(ctx context.Context) error {
+func (b *bazelClient) fillInfo(ctx context.Context) error {
 	b.info = map[string]string{}
 	output, err := b.run(ctx, "info")
 	if err != nil {
@@ -74,7 +174,7 @@ func (b *Bazel) fillInfo(ctx context.Context) error {
 	return nil
 }
 
-func (b *Bazel) run(ctx context.Context, command string, args ...string) (string, error) {
+func (b *bazelClient) run(ctx context.Context, command string, args ...string) (string, error) {
 	cmd := exec.CommandContext(ctx, b.bazelBin, append([]string{
 		command,
 		"--tool_tag=" + toolTag,
@@ -82,12 +182,20 @@ func (b *Bazel) run(ctx context.Context, command string, args ...string) (string
 	}, args...)...)
 	fmt.Fprintln(os.Stderr, "Running:", cmd.Args)
 	cmd.Dir = b.WorkspaceRoot()
-	cmd.Stderr = os.Stderr
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
 	output, err := cmd.Output()
-	return string(output), err
+	if err != nil {
+		return string(output), &BazelError{
+			Command: command,
+			Summary: errorSummary(stderr.String()),
+			Err:     err,
+		}
+	}
+	return string(output), nil
 }
 
-func (b *Bazel) Build(ctx context.Context, args ...string) ([]string, error) {
+func (b *bazelClient) Build(ctx context.Context, args ...string) ([]string, error) {
 	jsonFile, err := ioutil.TempFile("", "gopackagesdriver_bep_")
 	if err != nil {
 		return nil, fmt.Errorf("unable to create BEP JSON file: %w", err)
@@ -102,46 +210,67 @@ func (b *Bazel) Build(ctx context.Context, args ...string) ([]string, error) {
 		"--build_event_json_file=" + jsonFile.Name(),
 		"--build_event_json_file_path_conversion=no",
 	}, args...)
-	if _, err := b.run(ctx, "build", args...); err != nil {
-		// Ignore a regular build failure to get partial data.
+	_, buildErr := b.run(ctx, "build", args...)
+	if buildErr != nil {
+		// Keep a regular build failure to return partial data along with it.
 		// See https://docs.bazel.build/versions/main/guide.html#what-exit-code-will-i-get on
 		// exit codes.
 		var exerr *exec.ExitError
-		if !errors.As(err, &exerr) || exerr.ExitCode() != 1 {
-			return nil, fmt.Errorf("bazel build failed: %w", err)
+		if !errors.As(buildErr, &exerr) || exerr.ExitCode() != 1 {
+			return nil, buildErr
+		}
+	}
+
+	files, failed, err := readBEPFiles(jsonFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", jsonFile.Name(), err)
+	}
+
+	if buildErr != nil {
+		var bazelErr *BazelError
+		if errors.As(buildErr, &bazelErr) {
+			bazelErr.Targets = failed
 		}
+		return files, buildErr
 	}
+	return files, nil
+}
 
-	files := make([]string, 0)
-	decoder := json.NewDecoder(jsonFile)
+// readBEPFiles reads Build Event Protocol JSON events from r, and returns
+// the files they report and the labels of the targets that failed.
+func readBEPFiles(r io.Reader) (files, failed []string, err error) {
+	files = make([]string, 0)
+	decoder := json.NewDecoder(r)
 	for decoder.More() {
-		var namedSet BEPNamedSet
-		if err := decoder.Decode(&namedSet); err != nil {
-			return nil, fmt.Errorf("unable to decode %s: %w", jsonFile.Name(), err)
+		var event BEPEvent
+		if err := decoder.Decode(&event); err != nil {
+			return nil, nil, err
 		}
-		if namedSet.NamedSetOfFiles != nil {
-			for _, f := range namedSet.NamedSetOfFiles.Files {
+		if label := event.failedLabel(); label != "" {
+			failed = append(failed, label)
+		}
+		if event.NamedSetOfFiles != nil {
+			for _, f := range event.NamedSetOfFiles.Files {
 				fileUrl, err := url.Parse(f.URI)
 				if err != nil {
-					return nil, fmt.Errorf("unable to parse file URI: %w", err)
+					return nil, nil, fmt.Errorf("unable to parse file URI: %w", err)
 				}
 				files = append(files, filepath.FromSlash(fileUrl.Path))
 			}
 		}
 	}
-
-	return files, nil
+	return files, failed, nil
 }
 
-func (b *Bazel) Query(ctx context.Context, args ...string) ([]string, error) {
+func (b *bazelClient) Query(ctx context.Context, args ...string) ([]string, error) {
 	output, err := b.run(ctx, "query", args...)
 	if err != nil {
-		return nil, fmt.Errorf("bazel query failed: %w", err)
+		return nil, err
 	}
 	return strings.Split(strings.TrimSpace(output), "\n"), nil
 }
 
-func (b *Bazel) QueryLabels(ctx context.Context, args ...string) ([]string, error) {
+func (b *bazelClient) QueryLabels(ctx context.Context, args ...string) ([]string, error) {
 	output, err := b.run(ctx, "query", args...)
 	if err != nil {
 		return nil, fmt.Errorf("bazel query failed: %w", err)
@@ -149,14 +278,14 @@ func (b *Bazel) QueryLabels(ctx context.Context, args ...string) ([]string, erro
 	return strings.Split(strings.TrimSpace(output), "\n"), nil
 }
 
-func (b *Bazel) WorkspaceRoot() string {
+func (b *bazelClient) WorkspaceRoot() string {
 	return b.workspaceRoot
 }
 
-func (b *Bazel) ExecutionRoot() string {
+func (b *bazelClient) ExecutionRoot() string {
 	return b.info["execution_root"]
 }
 
-func (b *Bazel) OutputBase() string {
+func (b *bazelClient) OutputBase() string {
 	return b.info["output_base"]
 }
@@ -17,12 +17,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 )
 
 type BazelJSONBuilder struct {
-	bazel    *Bazel
+	bazel    Bazel
+	overlay  Overlay
+	tests    bool
 	requests []string
 }
 
@@ -31,6 +34,14 @@ const (
 )
 
 func (b *BazelJSONBuilder) fileQuery(filename string) string {
+	if _, ok := b.overlay[ensureAbsolutePathFromWorkspace(filename)]; ok {
+		// The file may be new, and not in any BUILD file yet, in which case
+		// same_pkg_direct_rdeps would fail. Load every Go target of its
+		// package instead; the file is matched with one of them by name.
+		if label := b.bazelPackageOf(filename); label != "" {
+			return fmt.Sprintf(`kind("go_library|go_test", %s:all)`, label)
+		}
+	}
 	if filepath.IsAbs(filename) {
 		fp, _ := filepath.Rel(b.bazel.WorkspaceRoot(), filename)
 		filename = fp
@@ -38,6 +49,31 @@ func (b *BazelJSONBuilder) fileQuery(filename string) string {
 	return fmt.Sprintf(`kind("go_library|go_test", same_pkg_direct_rdeps("%s"))`, filename)
 }
 
+// bazelPackageOf returns the label of the Bazel package containing
+// filename, which is the closest directory with a BUILD file. It returns ""
+// if the file is outside the workspace.
+func (b *BazelJSONBuilder) bazelPackageOf(filename string) string {
+	dir := filepath.Dir(ensureAbsolutePathFromWorkspace(filename))
+	for {
+		rel, err := filepath.Rel(b.bazel.WorkspaceRoot(), dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return ""
+		}
+		for _, name := range []string{"BUILD.bazel", "BUILD"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				if rel == "." {
+					return "//"
+				}
+				return "//" + filepath.ToSlash(rel)
+			}
+		}
+		if rel == "." {
+			return ""
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
 func (b *BazelJSONBuilder) packageQuery(importPath string) string {
 	if strings.HasSuffix(importPath, "/...") {
 		importPath = fmt.Sprintf(`^%s(/.+)?$`, strings.TrimSuffix(importPath, "/..."))
@@ -45,16 +81,30 @@ func (b *BazelJSONBuilder) packageQuery(importPath string) string {
 	return fmt.Sprintf(`kind("go_library", attr(importpath, "%s", deps(%s)))`, importPath, bazelQueryScope)
 }
 
+// testQuery returns a query for the go_test targets that depend directly on
+// the targets of query, which are the tests of those libraries.
+func (b *BazelJSONBuilder) testQuery(query string) string {
+	return fmt.Sprintf(`kind("go_test", rdeps(%s, %s, 1))`, bazelQueryScope, query)
+}
+
 func (b *BazelJSONBuilder) queryFromRequests(requests ...string) string {
 	ret := make([]string, 0, len(requests))
 	for _, request := range requests {
 		result := ""
 		if request == "." || request == "./..." {
-			if bazelQueryScope != "" {
+			if bazelQueryScope != "" && b.tests {
+				result = fmt.Sprintf(`kind("go_library|go_test", %s)`, bazelQueryScope)
+			} else if bazelQueryScope != "" {
 				result = fmt.Sprintf(`kind("go_library", %s)`, bazelQueryScope)
 			} else {
 				result = fmt.Sprintf(RulesGoStdlibLabel)
 			}
+		} else if isBazelPackagePattern(request) {
+			if b.tests {
+				result = fmt.Sprintf(`kind("go_library|go_test", %s)`, request)
+			} else {
+				result = fmt.Sprintf(`kind("go_library", %s)`, request)
+			}
 		} else if request == "builtin" || request == "std" {
 			result = fmt.Sprintf(RulesGoStdlibLabel)
 		} else if strings.HasPrefix(request, "file=") {
@@ -62,20 +112,35 @@ func (b *BazelJSONBuilder) queryFromRequests(requests ...string) string {
 			result = b.fileQuery(f)
 		} else if bazelQueryScope != "" {
 			result = b.packageQuery(request)
+			if b.tests {
+				result = fmt.Sprintf("%s union %s", result, b.testQuery(result))
+			}
 		}
 		if result != "" {
 			ret = append(ret, result)
 		}
 	}
+	if bazelQueryScope != "" {
+		// Unsaved files may import packages that nothing else in the
+		// request depends on yet.
+		for _, imp := range b.overlay.Imports() {
+			if isStdlibImportPath(imp) {
+				continue
+			}
+			ret = append(ret, b.packageQuery(imp))
+		}
+	}
 	if len(ret) == 0 {
 		return RulesGoStdlibLabel
 	}
 	return strings.Join(ret, " union ")
 }
 
-func NewBazelJSONBuilder(bazel *Bazel, requests ...string) (*BazelJSONBuilder, error) {
+func NewBazelJSONBuilder(bazel Bazel, overlay Overlay, tests bool, requests ...string) (*BazelJSONBuilder, error) {
 	return &BazelJSONBuilder{
 		bazel:    bazel,
+		overlay:  overlay,
+		tests:    tests,
 		requests: requests,
 	}, nil
 }
@@ -85,6 +150,13 @@ func (b *BazelJSONBuilder) outputGroupsForMode(mode LoadMode) string {
 	if mode&NeedExportsFile != 0 {
 		og += ",go_pkg_driver_export_file"
 	}
+	if mode&NeedCompiledGoFiles != 0 {
+		// Running cgo requires compiling the packages that use it.
+		og += ",go_pkg_driver_cgo_srcs"
+	}
+	if mode&(NeedEmbedFiles|NeedEmbedPatterns) != 0 {
+		og += ",go_pkg_driver_embedcfg"
+	}
 	return og
 }
 
@@ -99,34 +171,53 @@ func (b *BazelJSONBuilder) query(ctx context.Context, query string) ([]string, e
 		"--notool_deps",
 		query,
 	})
-	labels, err := b.bazel.Query(ctx, queryArgs...)
+	return b.bazel.Query(ctx, queryArgs...)
+}
+
+func (b *BazelJSONBuilder) Build(ctx context.Context, mode LoadMode) ([]string, error) {
+	labels, err := b.Labels(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to query: %w", err)
+		return nil, err
 	}
-	return labels, nil
+	return b.BuildLabels(ctx, mode, labels)
 }
 
-func (b *BazelJSONBuilder) Build(ctx context.Context, mode LoadMode) ([]string, error) {
-	labels, err := b.query(ctx, b.queryFromRequests(b.requests...))
+// Query returns the query for the targets matching the requests.
+func (b *BazelJSONBuilder) Query() string {
+	return b.queryFromRequests(b.requests...)
+}
+
+// Labels returns the labels of the targets matching the requests.
+func (b *BazelJSONBuilder) Labels(ctx context.Context) ([]string, error) {
+	labels, err := b.query(ctx, b.Query())
 	if err != nil {
-		return nil, fmt.Errorf("query failed: %w", err)
+		return nil, err
 	}
 
 	if len(labels) == 0 {
 		return nil, fmt.Errorf("found no labels matching the requests")
 	}
+	return labels, nil
+}
 
+// BuildLabels builds the aspect outputs of labels and returns the package
+// JSON files. If some targets fail to build, it returns the files that were
+// built along with a *BazelError.
+func (b *BazelJSONBuilder) BuildLabels(ctx context.Context, mode LoadMode, labels []string) ([]string, error) {
 	buildArgs := concatStringsArrays([]string{
 		"--experimental_convenience_symlinks=ignore",
 		"--ui_event_filters=-info,-stderr",
 		"--noshow_progress",
 		"--aspects=" + rulesGoRepositoryName + "//go/tools/gopackagesdriver:aspect.bzl%go_pkg_info_aspect",
 		"--output_groups=" + b.outputGroupsForMode(mode),
+		// Compile packages with the Go files generated by cgo and the
+		// resolved //go:embed patterns, which normal builds don't produce.
+		"--" + rulesGoRepositoryName + "//go/config:editor_outputs",
 		"--keep_going", // Build all possible packages
 	}, bazelFlags, bazelBuildFlags, labels)
 	files, err := b.bazel.Build(ctx, buildArgs...)
-	if err != nil {
-		return nil, fmt.Errorf("unable to bazel build %v: %w", buildArgs, err)
+	if err != nil && len(files) == 0 {
+		return nil, err
 	}
 
 	ret := []string{}
@@ -136,7 +227,7 @@ func (b *BazelJSONBuilder) Build(ctx context.Context, mode LoadMode) ([]string,
 		}
 	}
 
-	return ret, nil
+	return ret, err
 }
 
 func (b *BazelJSONBuilder) PathResolver() PathResolverFunc {
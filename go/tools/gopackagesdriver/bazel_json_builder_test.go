@@ -0,0 +1,157 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryFromRequests(t *testing.T) {
+	bazel := newFakeBazel(t, nil)
+	fooFile := filepath.Join(bazel.WorkspaceRoot(), "foo", "foo.go")
+
+	for _, tc := range []struct {
+		desc     string
+		scope    string
+		tests    bool
+		patterns []string
+		want     string
+	}{
+		{
+			desc:     "std",
+			scope:    "//...",
+			patterns: []string{"std"},
+			want:     `@io_bazel_rules_go//:stdlib`,
+		},
+		{
+			desc:     "builtin",
+			patterns: []string{"builtin"},
+			want:     `@io_bazel_rules_go//:stdlib`,
+		},
+		{
+			desc:     "dot_without_scope",
+			patterns: []string{"."},
+			want:     `@io_bazel_rules_go//:stdlib`,
+		},
+		{
+			desc:     "dot_with_scope",
+			scope:    "//...",
+			patterns: []string{"./..."},
+			want:     `kind("go_library", //...)`,
+		},
+		{
+			desc:     "import_path",
+			scope:    "//...",
+			patterns: []string{"example.com/repo/foo"},
+			want:     `kind("go_library", attr(importpath, "example.com/repo/foo", deps(//...)))`,
+		},
+		{
+			desc:     "import_path_without_scope",
+			patterns: []string{"example.com/repo/foo"},
+			want:     `@io_bazel_rules_go//:stdlib`,
+		},
+		{
+			desc:     "import_path_tests",
+			scope:    "//...",
+			tests:    true,
+			patterns: []string{"example.com/repo/foo"},
+			want: `kind("go_library", attr(importpath, "example.com/repo/foo", deps(//...)))` +
+				` union kind("go_test", rdeps(//..., kind("go_library", attr(importpath, "example.com/repo/foo", deps(//...))), 1))`,
+		},
+		{
+			desc:     "recursive",
+			scope:    "//...",
+			patterns: []string{"example.com/repo/..."},
+			want:     `kind("go_library", attr(importpath, "^example.com/repo(/.+)?$", deps(//...)))`,
+		},
+		{
+			desc:     "relative_file",
+			patterns: []string{"file=foo/foo.go"},
+			want:     `kind("go_library|go_test", same_pkg_direct_rdeps("foo/foo.go"))`,
+		},
+		{
+			desc:     "absolute_file",
+			patterns: []string{"file=" + fooFile},
+			want:     `kind("go_library|go_test", same_pkg_direct_rdeps("foo/foo.go"))`,
+		},
+		{
+			desc:     "bazel_package",
+			patterns: []string{"//foo:all"},
+			want:     `kind("go_library", //foo:all)`,
+		},
+		{
+			desc:     "bazel_packages_tests",
+			tests:    true,
+			patterns: []string{"//foo/..."},
+			want:     `kind("go_library|go_test", //foo/...)`,
+		},
+		{
+			desc:     "several",
+			scope:    "//...",
+			patterns: []string{"std", "example.com/repo/foo"},
+			want:     `@io_bazel_rules_go//:stdlib union kind("go_library", attr(importpath, "example.com/repo/foo", deps(//...)))`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			setGlobals(t, bazel.WorkspaceRoot(), tc.scope)
+			b, err := NewBazelJSONBuilder(bazel, Overlay{}, tc.tests, tc.patterns...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := b.Query(); got != tc.want {
+				t.Errorf("got query:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPathResolver(t *testing.T) {
+	bazel := newFakeBazel(t, nil)
+	b, err := NewBazelJSONBuilder(bazel, Overlay{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prf := b.PathResolver()
+
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{
+			path: "__BAZEL_WORKSPACE__/foo/foo.go",
+			want: bazel.WorkspaceRoot() + "/foo/foo.go",
+		},
+		{
+			path: "__BAZEL_EXECROOT__/bazel-out/k8-fastbuild/bin/foo/foo.x",
+			want: bazel.ExecutionRoot() + "/bazel-out/k8-fastbuild/bin/foo/foo.x",
+		},
+		{
+			path: "__BAZEL_OUTPUT_BASE__/external/go_sdk/src/fmt/print.go",
+			want: bazel.OutputBase() + "/external/go_sdk/src/fmt/print.go",
+		},
+		{
+			path: "/usr/include/stdio.h",
+			want: "/usr/include/stdio.h",
+		},
+		{
+			path: "",
+			want: "",
+		},
+	} {
+		if got := prf(tc.path); got != tc.want {
+			t.Errorf("resolving %q: got %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"go/build"
+	"go/types"
 	"os"
 	"path/filepath"
 	"strings"
@@ -26,11 +27,72 @@ func makeBuildContext() *build.Context {
 	return bctx
 }
 
-func filterSourceFilesForTags(files []string) []string {
+// BuildConfig is the configuration the aspect ran in, as recorded in the
+// package JSON files.
+type BuildConfig struct {
+	GOOS       string
+	GOARCH     string
+	Tags       []string
+	CgoEnabled bool
+}
+
+// context returns buildContext configured for c. A nil BuildConfig
+// returns buildContext, which uses the host configuration.
+func (c *BuildConfig) context() *build.Context {
+	if c == nil {
+		return buildContext
+	}
+	bctx := *buildContext
+	bctx.GOOS = c.GOOS
+	bctx.GOARCH = c.GOARCH
+	bctx.BuildTags = c.Tags
+	bctx.CgoEnabled = c.CgoEnabled
+	return &bctx
+}
+
+// Sizes returns the sizes of types for the target architecture.
+func (c *BuildConfig) Sizes() *types.StdSizes {
+	return sizesFor(c.context().GOARCH)
+}
+
+// gcArchSizes are the word sizes and maximum alignments used by gc, from
+// go/types.
+var gcArchSizes = map[string]*types.StdSizes{
+	"386":      {WordSize: 4, MaxAlign: 4},
+	"amd64":    {WordSize: 8, MaxAlign: 8},
+	"amd64p32": {WordSize: 4, MaxAlign: 8},
+	"arm":      {WordSize: 4, MaxAlign: 4},
+	"arm64":    {WordSize: 8, MaxAlign: 8},
+	"loong64":  {WordSize: 8, MaxAlign: 8},
+	"mips":     {WordSize: 4, MaxAlign: 4},
+	"mipsle":   {WordSize: 4, MaxAlign: 4},
+	"mips64":   {WordSize: 8, MaxAlign: 8},
+	"mips64le": {WordSize: 8, MaxAlign: 8},
+	"ppc64":    {WordSize: 8, MaxAlign: 8},
+	"ppc64le":  {WordSize: 8, MaxAlign: 8},
+	"riscv64":  {WordSize: 8, MaxAlign: 8},
+	"s390x":    {WordSize: 8, MaxAlign: 8},
+	"sparc64":  {WordSize: 8, MaxAlign: 8},
+	"wasm":     {WordSize: 8, MaxAlign: 8},
+}
+
+// sizesFor returns the sizes of types for goarch, falling back to amd64 for
+// unknown architectures. types.SizesFor can't be used since it doesn't
+// return a *types.StdSizes in recent versions of Go.
+func sizesFor(goarch string) *types.StdSizes {
+	sizes, ok := gcArchSizes[goarch]
+	if !ok {
+		sizes = gcArchSizes["amd64"]
+	}
+	s := *sizes
+	return &s
+}
+
+func filterSourceFilesForTags(bctx *build.Context, files []string) []string {
 	ret := make([]string, 0, len(files))
 	for _, f := range files {
 		dir, filename := filepath.Split(f)
-		if match, _ := buildContext.MatchFile(dir, filename); match {
+		if match, _ := bctx.MatchFile(dir, filename); match {
 			ret = append(ret, f)
 		}
 	}
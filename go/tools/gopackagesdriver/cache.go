@@ -0,0 +1,368 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cacheArg = "--cache"
+
+// cachedOutputs are the mode bits that change the outputs built for a
+// request, and so are part of the cache key.
+const cachedOutputs = NeedExportsFile | NeedCompiledGoFiles | NeedEmbedFiles | NeedEmbedPatterns
+
+// responseCache stores the package JSON files built for requests in the
+// output base, so that identical requests, like those made when an editor
+// restarts, don't run Bazel again. An entry is valid as long as the BUILD
+// and WORKSPACE files of the loaded packages and the .bzl files they load
+// are unchanged, and the source files too if compiled outputs were
+// requested. For recursive patterns, like //foo/..., BUILD files added or
+// removed under the pattern also invalidate the entry.
+type responseCache struct {
+	dir string
+}
+
+// cacheEntry is the result of a request, stored as JSON in a file named
+// after the key of the request.
+type cacheEntry struct {
+	Patterns  []string
+	Query     string
+	Labels    []string
+	JSONFiles []string
+	// Modules are the modules of the workspace, if they were requested.
+	// They only depend on the WORKSPACE, MODULE.bazel and go.mod files,
+	// which are part of Files.
+	Modules *Modules `json:",omitempty"`
+	// Files maps the files the entry depends on to the hash of their
+	// content, or to "" if they didn't exist.
+	Files map[string]string
+	// Recursive maps the directories of the recursive patterns of Query to
+	// the hash of the list of BUILD files under them.
+	Recursive map[string]string
+	Created   time.Time
+}
+
+// newResponseCache returns the cache of the output base of bazel, or nil if
+// caching is disabled.
+func newResponseCache(bazel Bazel) *responseCache {
+	if cacheDisabled || bazel.OutputBase() == "" {
+		return nil
+	}
+	return &responseCache{dir: filepath.Join(bazel.OutputBase(), "gopackagesdriver_cache")}
+}
+
+// key returns the key of a request for the targets of query. Patterns are
+// part of the query, along with the imports of the overlay.
+func (c *responseCache) key(query string, mode LoadMode) string {
+	h := sha256.New()
+	for _, s := range concatStringsArrays(
+		[]string{query, strconv.Itoa(int(mode & cachedOutputs)), bazelBin, rulesGoRepositoryName},
+		bazelFlags,
+		bazelQueryFlags,
+		bazelBuildFlags,
+	) {
+		fmt.Fprintf(h, "%q\n", s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the entry for key, or nil if there is none or it is no
+// longer valid.
+func (c *responseCache) get(key string) *cacheEntry {
+	if c == nil {
+		return nil
+	}
+	entry, err := c.read(key)
+	if err != nil || !entry.valid() {
+		return nil
+	}
+	return entry
+}
+
+func (c *responseCache) read(key string) (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, key+".json"))
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// put stores entry for key. Errors are ignored: the request is answered
+// anyway.
+func (c *responseCache) put(key string, entry *cacheEntry) {
+	if c == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(c.dir, key+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(c.dir, key+".json"))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// valid returns whether the JSON files of e still exist and the files it
+// depends on are unchanged.
+func (e *cacheEntry) valid() bool {
+	for _, f := range e.JSONFiles {
+		if _, err := os.Stat(f); err != nil {
+			return false
+		}
+	}
+	for dir, hash := range e.Recursive {
+		if hashBuildFileList(dir) != hash {
+			return false
+		}
+	}
+	for f, hash := range e.Files {
+		if hashFile(f) != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheDependencies returns the hashes of the files the packages in
+// registry were loaded from: the WORKSPACE files, the BUILD files of the
+// packages in the workspace and of the directories under the recursive
+// patterns of query, the .bzl files of the workspace they load and, if
+// sources is set, the source files of the packages.
+func cacheDependencies(registry *PackageRegistry, query string, sources bool) map[string]string {
+	files := map[string]string{}
+	var add func(path string)
+	add = func(path string) {
+		if _, ok := files[path]; ok {
+			return
+		}
+		files[path] = hashFile(path)
+		if files[path] != "" && !strings.HasSuffix(path, ".go") {
+			for _, bzl := range loadedBzlFiles(path) {
+				add(bzl)
+			}
+		}
+	}
+	for _, name := range []string{"WORKSPACE", "WORKSPACE.bazel", "WORKSPACE.bzlmod", "MODULE.bazel", "go.mod"} {
+		add(filepath.Join(workspaceRoot, name))
+	}
+	for _, dir := range recursivePatternDirs(query) {
+		for _, f := range buildFilesUnder(dir) {
+			add(f)
+		}
+	}
+	for _, pkg := range registry.packagesByID {
+		for _, f := range concatStringsArrays(pkg.GoFiles, pkg.OtherFiles) {
+			if !strings.HasPrefix(f, workspaceRoot+string(filepath.Separator)) {
+				continue
+			}
+			dir := filepath.Dir(f)
+			add(filepath.Join(dir, "BUILD.bazel"))
+			add(filepath.Join(dir, "BUILD"))
+			if sources {
+				add(f)
+			}
+		}
+	}
+	return files
+}
+
+// recursivePatternRegexp matches the recursive target patterns of the main
+// repository in a query, like //... or //foo/...
+var recursivePatternRegexp = regexp.MustCompile(`(@@?[\w.~+-]*)?//([^\s,()":]*?)/?\.\.\.`)
+
+// recursivePatternDirs returns the directories of the recursive target
+// patterns of the main repository in query.
+func recursivePatternDirs(query string) []string {
+	dirs := map[string]bool{}
+	for _, match := range recursivePatternRegexp.FindAllStringSubmatch(query, -1) {
+		if repo := strings.TrimLeft(match[1], "@"); repo != "" {
+			continue
+		}
+		dirs[filepath.Join(workspaceRoot, filepath.FromSlash(match[2]))] = true
+	}
+	return sortedKeys(dirs)
+}
+
+// recursiveDependencies returns the hash of the list of BUILD files under
+// the directories of the recursive patterns of query.
+func recursiveDependencies(query string) map[string]string {
+	recursive := map[string]string{}
+	for _, dir := range recursivePatternDirs(query) {
+		recursive[dir] = hashBuildFileList(dir)
+	}
+	return recursive
+}
+
+// buildFilesUnder returns the BUILD files in dir and its subdirectories,
+// skipping hidden directories and the convenience symlinks of Bazel, which
+// filepath.Walk doesn't follow.
+func buildFilesUnder(dir string) []string {
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == "BUILD" || info.Name() == "BUILD.bazel" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
+
+// hashBuildFileList returns the hash of the list of BUILD files under dir.
+func hashBuildFileList(dir string) string {
+	h := sha256.New()
+	for _, f := range buildFilesUnder(dir) {
+		fmt.Fprintln(h, f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// bzlLabelRegexp matches labels of .bzl files in strings, like those
+// loaded with load() or passed to use_extension().
+var bzlLabelRegexp = regexp.MustCompile(`"(@@?[\w.~+-]*)?(//[^":]*)?:?([^":]+\.bzl)"`)
+
+// loadedBzlFiles returns the .bzl files of the main repository that the
+// BUILD, WORKSPACE, MODULE.bazel or .bzl file at path refers to.
+func loadedBzlFiles(path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, match := range bzlLabelRegexp.FindAllStringSubmatch(string(data), -1) {
+		if repo := strings.TrimLeft(match[1], "@"); repo != "" {
+			continue
+		}
+		dir := filepath.Dir(path)
+		if match[2] != "" {
+			dir = filepath.Join(workspaceRoot, filepath.FromSlash(strings.TrimPrefix(match[2], "//")))
+		}
+		files = append(files, filepath.Join(dir, filepath.FromSlash(match[3])))
+	}
+	return files
+}
+
+// hashFile returns the hash of the content of path, or "" if it can't be
+// read.
+func hashFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// runCacheCommand implements "gopackagesdriver --cache [list|clear]", which
+// lists the entries of the cache of the workspace or removes them.
+func runCacheCommand(args []string) error {
+	command := "list"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	bazel, err := NewBazel(context.Background(), bazelBin, workspaceRoot)
+	if err != nil {
+		return fmt.Errorf("unable to create bazel instance: %w", err)
+	}
+	c := &responseCache{dir: filepath.Join(bazel.OutputBase(), "gopackagesdriver_cache")}
+
+	switch command {
+	case "list":
+		return c.list(os.Stdout)
+	case "clear":
+		if err := os.RemoveAll(c.dir); err != nil {
+			return fmt.Errorf("unable to clear cache: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Removed %s\n", c.dir)
+		return nil
+	default:
+		return fmt.Errorf("unknown cache command %q, expected list or clear", command)
+	}
+}
+
+// list prints the entries of the cache, with whether they are still valid.
+func (c *responseCache) list(w io.Writer) error {
+	entries, err := ioutil.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read cache: %w", err)
+	}
+	var keys []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".json") {
+			keys = append(keys, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry, err := c.read(key)
+		if err != nil {
+			fmt.Fprintf(w, "%s\tinvalid: %v\n", key, err)
+			continue
+		}
+		state := "valid"
+		if !entry.valid() {
+			state = "stale"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d package files\t%s\n",
+			key, state, entry.Created.Format(time.RFC3339), len(entry.JSONFiles), strings.Join(entry.Patterns, " "))
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheEntryValid(t *testing.T) {
+	files := map[string]string{
+		"WORKSPACE":       `load("//:deps.bzl", "go_dependencies")`,
+		"deps.bzl":        `load(":more.bzl", "more")`,
+		"more.bzl":        `more = 1`,
+		"foo/BUILD.bazel": `load("@io_bazel_rules_go//go:def.bzl", "go_library")`,
+		"bar/BUILD.bazel": ``,
+	}
+	for _, tc := range []struct {
+		desc  string
+		query string
+		edit  func(root string) error
+		valid bool
+	}{
+		{
+			desc:  "unchanged",
+			query: `kind("go_library", //foo/...)`,
+			valid: true,
+		},
+		{
+			desc:  "loaded_bzl",
+			query: `kind("go_library", //foo/...)`,
+			edit: func(root string) error {
+				return ioutil.WriteFile(filepath.Join(root, "more.bzl"), []byte("more = 2"), 0666)
+			},
+		},
+		{
+			desc:  "added_build_file",
+			query: `kind("go_library", //foo/...)`,
+			edit: func(root string) error {
+				return ioutil.WriteFile(filepath.Join(root, "foo/baz/BUILD.bazel"), nil, 0666)
+			},
+		},
+		{
+			desc:  "removed_build_file",
+			query: `kind("go_library", //...)`,
+			edit: func(root string) error {
+				return os.Remove(filepath.Join(root, "bar/BUILD.bazel"))
+			},
+		},
+		{
+			desc:  "build_file_outside_pattern",
+			query: `kind("go_library", //foo/...)`,
+			edit: func(root string) error {
+				return os.Remove(filepath.Join(root, "bar/BUILD.bazel"))
+			},
+			valid: true,
+		},
+		{
+			desc:  "external_pattern",
+			query: `kind("go_library", //foo/... union @other//...)`,
+			edit: func(root string) error {
+				return ioutil.WriteFile(filepath.Join(root, "BUILD.bazel"), nil, 0666)
+			},
+			valid: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			root := t.TempDir()
+			setGlobals(t, root, "//...")
+			for name, content := range files {
+				path := filepath.Join(root, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.MkdirAll(filepath.Join(root, "foo/baz"), 0777); err != nil {
+				t.Fatal(err)
+			}
+
+			entry := &cacheEntry{
+				Query:     tc.query,
+				Files:     cacheDependencies(NewPackageRegistry(), tc.query, false),
+				Recursive: recursiveDependencies(tc.query),
+			}
+			if !entry.valid() {
+				t.Fatal("entry is not valid right after it was created")
+			}
+			if tc.edit != nil {
+				if err := tc.edit(root); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := entry.valid(); got != tc.valid {
+				t.Errorf("got valid %v, want %v", got, tc.valid)
+			}
+		})
+	}
+}
+
+func TestCacheEntryModules(t *testing.T) {
+	c := &responseCache{dir: t.TempDir()}
+	modules := &Modules{
+		main:       &Module{Path: "example.com/repo", Main: true},
+		outputBase: "/output_base",
+		byRepo: map[string]*Module{
+			"com_example_other": {Path: "example.com/other", Version: "v1.2.3"},
+		},
+	}
+	c.put("key", &cacheEntry{Modules: modules})
+
+	entry, err := c.read("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entry.Modules.ForRepo(""); got == nil || got.Path != "example.com/repo" || !got.Main {
+		t.Errorf("got main module %+v, want example.com/repo", got)
+	}
+	if got := entry.Modules.ForRepo("com_example_other"); got == nil || got.Path != "example.com/other" || got.Version != "v1.2.3" {
+		t.Errorf("got module %+v for com_example_other, want example.com/other@v1.2.3", got)
+	}
+}
@@ -0,0 +1,558 @@
+// Copyright 2023 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// When GOPACKAGESDRIVER_DAEMON is set, the driver is a thin client that
+// forwards requests over a Unix socket to a resident process, started on
+// demand by running the driver with serveArg. The daemon keeps the loaded
+// packages in memory, and only queries and builds again the targets whose
+// BUILD or source files changed since they were loaded.
+
+// serveArg is the argument the driver is run with to start the daemon.
+const serveArg = "--serve"
+
+// daemonStartTimeout is how long the client waits for a daemon it started
+// to accept connections.
+const daemonStartTimeout = 10 * time.Second
+
+type daemonRequest struct {
+	Request  *DriverRequest
+	Patterns []string
+}
+
+type daemonResponse struct {
+	Response *driverResponse
+	Error    string `json:",omitempty"`
+}
+
+// daemonSocketPath returns the path of the socket of the daemon. There is a
+// daemon per workspace and configuration, so that changing the flags passed
+// to Bazel starts a new one. Sockets are in a directory of the user cache
+// that only the user can access, so that other users can't listen on them
+// in place of the daemon, or read its log.
+func daemonSocketPath() (string, error) {
+	if daemonSocket != "" {
+		return daemonSocket, nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cacheDir, "gopackagesdriver")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// MkdirAll doesn't change the permissions of an existing directory.
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, s := range concatStringsArrays(
+		[]string{workspaceRoot, bazelBin, rulesGoRepositoryName, bazelQueryScope},
+		bazelFlags, bazelQueryFlags, bazelBuildFlags,
+	) {
+		fmt.Fprintln(h, s)
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x.sock", h.Sum(nil)[:8])), nil
+}
+
+// runClient sends the request read from stdin to the daemon, starting it if
+// needed, and returns its response.
+func runClient() (*driverResponse, error) {
+	ctx, cancel := signalContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	request, err := ReadDriverRequest(os.Stdin)
+	if err != nil {
+		return emptyResponse, fmt.Errorf("unable to read request: %w", err)
+	}
+	// Overlay paths are relative to the working directory of the client,
+	// which the daemon doesn't share.
+	request.Overlay = NewOverlay(request.Overlay)
+
+	conn, err := dialDaemon(ctx)
+	if err != nil {
+		return emptyResponse, err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Relative patterns are resolved against the working directory of the
+	// client too.
+	patterns := os.Args[1:]
+	if wd, err := os.Getwd(); err == nil {
+		patterns = resolveRelativePatterns(wd, patterns)
+	}
+	if err := json.NewEncoder(conn).Encode(daemonRequest{
+		Request:  request,
+		Patterns: patterns,
+	}); err != nil {
+		return emptyResponse, fmt.Errorf("unable to send request to daemon: %w", err)
+	}
+	var response daemonResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return emptyResponse, fmt.Errorf("unable to read response from daemon: %w", err)
+	}
+	if response.Response == nil {
+		response.Response = emptyResponse
+	}
+	if response.Error != "" {
+		return response.Response, errors.New(response.Error)
+	}
+	return response.Response, nil
+}
+
+// dialDaemon connects to the daemon, starting it if it's not running.
+func dialDaemon(ctx context.Context) (net.Conn, error) {
+	path, err := daemonSocketPath()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find daemon socket: %w", err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		return conn, nil
+	}
+	if err := startDaemon(path); err != nil {
+		return nil, fmt.Errorf("unable to start daemon: %w", err)
+	}
+	deadline := time.Now().Add(daemonStartTimeout)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("unable to connect to daemon at %s (see %s.log): %w", path, path, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// startDaemon starts the daemon listening on socket in the background. Its
+// output is written next to the socket.
+func startDaemon(socket string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	log, err := os.OpenFile(socket+".log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	cmd := exec.Command(exe, serveArg)
+	cmd.Env = append(os.Environ(), "GOPACKAGESDRIVER_DAEMON_SOCKET="+socket)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// serve runs the daemon until it is interrupted or stays idle for
+// daemonIdleTimeout.
+func serve() error {
+	ctx, cancel := signalContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	path, err := daemonSocketPath()
+	if err != nil {
+		return fmt.Errorf("unable to find daemon socket: %w", err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	// The socket may be left over from a daemon that crashed.
+	os.Remove(path)
+
+	bazel, err := NewBazel(ctx, bazelBin, workspaceRoot)
+	if err != nil {
+		return fmt.Errorf("unable to create bazel instance: %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", path, err)
+	}
+	defer l.Close()
+	fmt.Fprintln(os.Stderr, "Listening on", path)
+
+	d := newDaemon(bazel)
+	go d.stopWhenIdle(ctx, cancel)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go d.serveConn(ctx, conn)
+	}
+}
+
+// watchedFile is a file or directory whose changes invalidate the results
+// of the daemon.
+type watchedFile struct {
+	modTime time.Time
+	// labels are the targets to build again when the file changes. If
+	// there are none, everything is loaded again.
+	labels []string
+	// structural is set for BUILD files and directories: when they change,
+	// targets or their sources may have been added or removed, so queries
+	// must run again.
+	structural bool
+	// recursive is set for the directories under the recursive patterns
+	// of queries, like //..., which only the queries depend on.
+	recursive bool
+}
+
+type daemon struct {
+	// mu serializes requests: Bazel can only run one command at a time
+	// anyway, and buildContext is shared.
+	mu sync.Mutex
+
+	bazel       Bazel
+	lastRequest time.Time
+
+	// queries maps the queries that were run to the labels they matched.
+	queries map[string][]string
+	// built maps the labels whose aspect outputs were built to the mode
+	// bits that required optional outputs, like export files.
+	built map[string]LoadMode
+	// dirty are the labels whose inputs changed since they were built.
+	dirty map[string]bool
+	// jsonFiles are the package JSON files built since the queries last
+	// ran. Builds don't tell which label each file belongs to, so they are
+	// all dropped when queries must run again, since the labels matching
+	// them may have changed.
+	jsonFiles map[string]bool
+	// driver holds the packages loaded from jsonFiles, without overlay. It
+	// is nil if they must be loaded again.
+	driver *JSONPackagesDriver
+	// driverCgoMode is the typecheckCgo bit driver was loaded with.
+	driverCgoMode LoadMode
+	// modules are the modules of the workspace, or nil if they must be
+	// found again.
+	modules *Modules
+	watched map[string]*watchedFile
+}
+
+func newDaemon(bazel Bazel) *daemon {
+	return &daemon{
+		bazel:       bazel,
+		lastRequest: time.Now(),
+		queries:     map[string][]string{},
+		built:       map[string]LoadMode{},
+		dirty:       map[string]bool{},
+		jsonFiles:   map[string]bool{},
+		watched:     map[string]*watchedFile{},
+	}
+}
+
+func (d *daemon) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	var request daemonRequest
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to decode request: %v\n", err)
+		return
+	}
+	if request.Request == nil {
+		request.Request = &DriverRequest{}
+	}
+	var response daemonResponse
+	resp, err := d.handle(ctx, &request)
+	response.Response = resp
+	if err != nil {
+		response.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to encode response: %v\n", err)
+	}
+}
+
+// handle answers a request like run, but only runs the queries and builds
+// the targets that changed since the previous requests.
+func (d *daemon) handle(ctx context.Context, request *daemonRequest) (*driverResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastRequest = time.Now()
+
+	// Editors request packages right after saving files, so look for
+	// changes now rather than periodically.
+	d.poll()
+
+	overlay := NewOverlay(request.Request.Overlay)
+	buildContext.OpenFile = overlay.OpenFile
+
+	bazelJsonBuilder, err := NewBazelJSONBuilder(d.bazel, overlay, request.Request.Tests, request.Patterns...)
+	if err != nil {
+		return emptyResponse, fmt.Errorf("unable to build JSON files: %w", err)
+	}
+
+	query := bazelJsonBuilder.Query()
+	labels, ok := d.queries[query]
+	if !ok {
+		labels, err = bazelJsonBuilder.Labels(ctx)
+		if err != nil {
+			return withLoadError(emptyResponse, err, request.Patterns), fmt.Errorf("unable to build JSON files: %w", err)
+		}
+		d.queries[query] = labels
+		d.watchRecursive(query)
+	}
+
+	outputs := request.Request.Mode & (NeedExportsFile | NeedCompiledGoFiles | NeedEmbedFiles | NeedEmbedPatterns)
+	stale := map[string]bool{}
+	for _, label := range labels {
+		if built, ok := d.built[label]; !ok || outputs&^built != 0 {
+			stale[label] = true
+		}
+	}
+	for label := range d.dirty {
+		stale[label] = true
+	}
+	var buildErr error
+	if len(stale) > 0 {
+		var jsonFiles []string
+		jsonFiles, buildErr = bazelJsonBuilder.BuildLabels(ctx, request.Request.Mode, sortedKeys(stale))
+		if buildErr != nil && len(jsonFiles) == 0 {
+			return withLoadError(emptyResponse, buildErr, request.Patterns), fmt.Errorf("unable to build JSON files: %w", buildErr)
+		}
+		// Files of targets that were removed since they were built are
+		// gone after a build.
+		for f := range d.jsonFiles {
+			if _, err := os.Stat(f); err != nil {
+				delete(d.jsonFiles, f)
+			}
+		}
+		for _, f := range jsonFiles {
+			d.jsonFiles[f] = true
+		}
+		for label := range stale {
+			// Optional outputs that were not built again may be out of
+			// date.
+			d.built[label] = outputs
+		}
+		d.dirty = map[string]bool{}
+		var bazelErr *BazelError
+		if errors.As(buildErr, &bazelErr) {
+			// Build the targets that failed again next time, to report
+			// the error until it's fixed.
+			for _, label := range bazelErr.Targets {
+				d.dirty[label] = true
+			}
+		}
+		d.driver = nil
+	}
+
+	driver := d.driver
+	cgoMode := request.Request.Mode & typecheckCgo
+	if driver == nil || len(overlay) > 0 || cgoMode != d.driverCgoMode {
+		driver, err = NewJSONPackagesDriver(sortedKeys(d.jsonFiles), bazelJsonBuilder.PathResolver(), overlay, request.Request.Mode)
+		if err != nil {
+			return withLoadError(emptyResponse, err, request.Patterns), fmt.Errorf("unable to load JSON files: %w", err)
+		}
+		d.watch(driver.registry)
+		if len(overlay) == 0 {
+			d.driver = driver
+			d.driverCgoMode = cgoMode
+		}
+	}
+
+	if request.Request.Mode&NeedModule != 0 {
+		if d.modules == nil {
+			d.modules = bazelJsonBuilder.Modules(ctx)
+		}
+		driver.SetModules(d.modules)
+	}
+
+	response := driver.Match(request.Request.Tests, request.Patterns...)
+	if buildErr != nil {
+		return withLoadError(response, buildErr, request.Patterns), fmt.Errorf("unable to build JSON files: %w", buildErr)
+	}
+	return response, nil
+}
+
+// watch records the modification times of the source files of the
+// packages in registry, of their directories and of their BUILD files.
+// Files outside of the workspace, like those of external repositories and
+// generated files, are not watched.
+func (d *daemon) watch(registry *PackageRegistry) {
+	d.watched = map[string]*watchedFile{}
+	add := d.addWatched
+	for query := range d.queries {
+		d.watchRecursive(query)
+	}
+	for _, name := range []string{"WORKSPACE", "WORKSPACE.bazel", "MODULE.bazel", "go.mod"} {
+		add(filepath.Join(workspaceRoot, name), "", true)
+	}
+	for _, pkg := range registry.packagesByID {
+		if pkg.IsStdlib() {
+			continue
+		}
+		label := pkg.Label()
+		for _, f := range concatStringsArrays(pkg.GoFiles, pkg.OtherFiles) {
+			if !strings.HasPrefix(f, workspaceRoot+string(filepath.Separator)) {
+				continue
+			}
+			add(f, label, false)
+			dir := filepath.Dir(f)
+			add(dir, label, true)
+			add(filepath.Join(dir, "BUILD.bazel"), label, true)
+			add(filepath.Join(dir, "BUILD"), label, true)
+		}
+	}
+}
+
+// watchRecursive records the modification times of the directories under
+// the recursive patterns of query. A directory changes when a file or
+// directory is created in it, like a new BUILD file, which may add targets
+// matching the query even though no package was loaded from there.
+func (d *daemon) watchRecursive(query string) {
+	for _, root := range recursivePatternDirs(query) {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			d.addWatched(path, "", true).recursive = true
+			return nil
+		})
+	}
+}
+
+// addWatched watches path for changes that invalidate the results of
+// label, or all results if label is empty.
+func (d *daemon) addWatched(path, label string, structural bool) *watchedFile {
+	w, ok := d.watched[path]
+	if !ok {
+		w = &watchedFile{modTime: modTime(path), structural: structural}
+		d.watched[path] = w
+	}
+	if label != "" {
+		w.labels = append(w.labels, label)
+	}
+	return w
+}
+
+// poll invalidates the results that depend on watched files that changed.
+// It stats every watched file, so its cost grows with the number of source
+// files, directories and BUILD files of the loaded packages, and with the
+// number of directories under recursive patterns; it runs once per request.
+func (d *daemon) poll() {
+	for path, w := range d.watched {
+		t := modTime(path)
+		if t.Equal(w.modTime) {
+			continue
+		}
+		w.modTime = t
+		d.driver = nil
+		if w.structural {
+			// Targets may have been added, removed or renamed, so build
+			// again the targets matching the queries when they run again.
+			d.queries = map[string][]string{}
+			d.built = map[string]LoadMode{}
+			d.jsonFiles = map[string]bool{}
+		}
+		if len(w.labels) == 0 {
+			d.built = map[string]LoadMode{}
+			if !w.recursive {
+				d.modules = nil
+			}
+			continue
+		}
+		for _, label := range w.labels {
+			d.dirty[label] = true
+		}
+	}
+}
+
+// stopWhenIdle calls stop once no request was received for
+// daemonIdleTimeout.
+func (d *daemon) stopWhenIdle(ctx context.Context, stop func()) {
+	if daemonIdleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(daemonIdleTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.mu.Lock()
+		idle := time.Since(d.lastRequest)
+		d.mu.Unlock()
+		if idle > daemonIdleTimeout {
+			fmt.Fprintln(os.Stderr, "Stopping after being idle for", idle)
+			stop()
+			return
+		}
+	}
+}
+
+// modTime returns the modification time of path, or the zero time if it
+// doesn't exist.
+func modTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
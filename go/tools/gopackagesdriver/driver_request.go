@@ -62,6 +62,12 @@ const (
 
 	// NeedModule adds Module.
 	NeedModule
+
+	// NeedEmbedFiles adds EmbedFiles.
+	NeedEmbedFiles
+
+	// NeedEmbedPatterns adds EmbedPatterns.
+	NeedEmbedPatterns
 )
 
 // From https://github.com/golang/tools/blob/v0.1.0/go/packages/external.go#L32
@@ -73,10 +79,10 @@ type DriverRequest struct {
 	// BuildFlags are flags that should be passed to the underlying build system.
 	// BuildFlags []string `json:"build_flags"`
 	// Tests specifies whether the patterns should also return test packages.
-	// Tests bool `json:"tests"`
+	Tests bool `json:"tests"`
 	// Overlay maps file paths (relative to the driver's working directory) to the byte contents
 	// of overlay files.
-	// Overlay map[string][]byte `json:"overlay"`
+	Overlay map[string][]byte `json:"overlay"`
 }
 
 func ReadDriverRequest(r io.Reader) (*DriverRequest, error) {
@@ -0,0 +1,119 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeBazel replays recorded Bazel outputs instead of running Bazel. Query
+// returns the output recorded for the query expression, which is the last
+// argument, and Build returns the files of the recorded BEP JSON events.
+type fakeBazel struct {
+	workspaceRoot string
+	executionRoot string
+	outputBase    string
+
+	// queries maps query expressions to their output.
+	queries map[string]string
+	// bep holds the BEP JSON events of builds. __WORKSPACE__ and
+	// __EXECROOT__ are replaced with the workspace and execution roots.
+	bep string
+
+	// ran records the commands that were run, like "query <expr>" or
+	// "build <labels...>".
+	ran []string
+}
+
+var _ Bazel = (*fakeBazel)(nil)
+
+// newFakeBazel returns a fake replaying testdata/bep.json, with the
+// workspace in testdata/workspace and the execution root in
+// testdata/execroot.
+func newFakeBazel(t *testing.T, queries map[string]string) *fakeBazel {
+	t.Helper()
+	testdata, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bep, err := ioutil.ReadFile(filepath.Join(testdata, "bep.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeBazel{
+		workspaceRoot: filepath.Join(testdata, "workspace"),
+		executionRoot: filepath.Join(testdata, "execroot"),
+		outputBase:    filepath.Join(testdata, "output_base"),
+		queries:       queries,
+		bep:           string(bep),
+	}
+}
+
+func (b *fakeBazel) Build(ctx context.Context, args ...string) ([]string, error) {
+	var labels []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			labels = append(labels, arg)
+		}
+	}
+	b.ran = append(b.ran, "build "+strings.Join(labels, " "))
+	bep := strings.NewReplacer(
+		"__WORKSPACE__", filepath.ToSlash(b.workspaceRoot),
+		"__EXECROOT__", filepath.ToSlash(b.executionRoot),
+	).Replace(b.bep)
+	files, _, err := readBEPFiles(strings.NewReader(bep))
+	return files, err
+}
+
+func (b *fakeBazel) Query(ctx context.Context, args ...string) ([]string, error) {
+	query := args[len(args)-1]
+	b.ran = append(b.ran, "query "+query)
+	output, ok := b.queries[query]
+	if !ok {
+		return nil, &BazelError{
+			Command: "query",
+			Err:     fmt.Errorf("no recorded output for %s", query),
+		}
+	}
+	return strings.Split(strings.TrimSpace(output), "\n"), nil
+}
+
+func (b *fakeBazel) WorkspaceRoot() string {
+	return b.workspaceRoot
+}
+
+func (b *fakeBazel) ExecutionRoot() string {
+	return b.executionRoot
+}
+
+func (b *fakeBazel) OutputBase() string {
+	return b.outputBase
+}
+
+// setGlobals sets the configuration the driver reads from the environment
+// for the duration of the test.
+func setGlobals(t *testing.T, root, scope string) {
+	t.Helper()
+	oldRoot, oldScope := workspaceRoot, bazelQueryScope
+	workspaceRoot, bazelQueryScope = root, scope
+	t.Cleanup(func() {
+		workspaceRoot, bazelQueryScope = oldRoot, oldScope
+	})
+}
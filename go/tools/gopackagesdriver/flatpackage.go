@@ -15,11 +15,17 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -56,6 +62,7 @@ type FlatPackage struct {
 	ID              string
 	Name            string              `json:",omitempty"`
 	PkgPath         string              `json:",omitempty"`
+	ForTest         string              `json:",omitempty"`
 	Errors          []FlatPackagesError `json:",omitempty"`
 	GoFiles         []string            `json:",omitempty"`
 	CompiledGoFiles []string            `json:",omitempty"`
@@ -63,6 +70,31 @@ type FlatPackage struct {
 	ExportFile      string              `json:",omitempty"`
 	Imports         map[string]string   `json:",omitempty"`
 	Standard        bool                `json:",omitempty"`
+	Module          *Module             `json:",omitempty"`
+	EmbedPatterns   []string            `json:",omitempty"`
+	EmbedFiles      []string            `json:",omitempty"`
+
+	// config is the configuration the package was built in. It is nil for
+	// packages of the standard library.
+	config *BuildConfig
+	// cgoSrcsDir is the directory containing the Go files generated by cgo,
+	// if the package uses cgo.
+	cgoSrcsDir string
+	// embedcfg is the file mapping the //go:embed patterns of the package
+	// to the files they match, if the package embeds files.
+	embedcfg string
+	// repo is the name of the external repository of the package, or "" if
+	// the package is in the main workspace.
+	repo string
+}
+
+// pkgJSON is a package as written by the aspect.
+type pkgJSON struct {
+	*FlatPackage
+	Config     *BuildConfig
+	CgoSrcsDir string
+	EmbedCfg   string
+	Repo       string
 }
 
 type (
@@ -85,11 +117,15 @@ func WalkFlatPackagesFromJSON(jsonFile string, onPkg PackageFunc) error {
 
 	decoder := json.NewDecoder(f)
 	for decoder.More() {
-		pkg := &FlatPackage{}
+		pkg := pkgJSON{FlatPackage: &FlatPackage{}}
 		if err := decoder.Decode(&pkg); err != nil {
 			return fmt.Errorf("unable to decode package in %s: %w", f.Name(), err)
 		}
-		onPkg(pkg)
+		pkg.FlatPackage.config = pkg.Config
+		pkg.FlatPackage.cgoSrcsDir = pkg.CgoSrcsDir
+		pkg.FlatPackage.embedcfg = pkg.EmbedCfg
+		pkg.FlatPackage.repo = pkg.Repo
+		onPkg(pkg.FlatPackage)
 	}
 	return nil
 }
@@ -99,21 +135,183 @@ func (fp *FlatPackage) ResolvePaths(prf PathResolverFunc) error {
 	resolvePathsInPlace(prf, fp.GoFiles)
 	resolvePathsInPlace(prf, fp.OtherFiles)
 	fp.ExportFile = prf(fp.ExportFile)
+	if fp.cgoSrcsDir != "" {
+		fp.cgoSrcsDir = prf(fp.cgoSrcsDir)
+	}
+	if fp.embedcfg != "" {
+		fp.embedcfg = prf(fp.embedcfg)
+	}
 	return nil
 }
 
-// FilterFilesForBuildTags filters the source files given the current build
-// tags.
-func (fp *FlatPackage) FilterFilesForBuildTags() {
-	fp.GoFiles = filterSourceFilesForTags(fp.GoFiles)
-	fp.CompiledGoFiles = filterSourceFilesForTags(fp.CompiledGoFiles)
+// ReadEmbedFiles sets EmbedPatterns and EmbedFiles from the embedcfg file
+// written when the package was compiled. The files are relative to the
+// execution root, and are resolved to the workspace, the output base or
+// the execution root like the other files of the package. Packages stay
+// unchanged if the file was not built.
+func (fp *FlatPackage) ReadEmbedFiles(prf PathResolverFunc) {
+	if fp.embedcfg == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(fp.embedcfg)
+	if err != nil {
+		return
+	}
+	var embedcfg struct {
+		Patterns map[string][]string
+		Files    map[string]string
+	}
+	if err := json.Unmarshal(data, &embedcfg); err != nil {
+		return
+	}
+
+	fp.EmbedPatterns = nil
+	for pattern := range embedcfg.Patterns {
+		fp.EmbedPatterns = append(fp.EmbedPatterns, pattern)
+	}
+	sort.Strings(fp.EmbedPatterns)
+
+	fp.EmbedFiles = nil
+	seen := map[string]bool{}
+	for _, file := range embedcfg.Files {
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		prefix := "__BAZEL_WORKSPACE__"
+		if strings.HasPrefix(file, "bazel-out/") {
+			prefix = "__BAZEL_EXECROOT__"
+		} else if strings.HasPrefix(file, "external/") {
+			prefix = "__BAZEL_OUTPUT_BASE__"
+		}
+		fp.EmbedFiles = append(fp.EmbedFiles, prf(filepath.Join(prefix, filepath.FromSlash(file))))
+	}
+	sort.Strings(fp.EmbedFiles)
+}
+
+// ExpandCgoFiles replaces the files that use cgo in CompiledGoFiles with the
+// files generated by cgo, like the go command does. If typecheckCgo is set,
+// the files that use cgo are kept and only _cgo_gotypes.go, which declares
+// the C symbols, is added first, which is what go/packages does with go
+// list so that go/types checks the original files. Packages stay unchanged
+// if the generated files were not built.
+//
+// The //line directives of the generated files refer to the original files
+// with the placeholders resolved by prf, so the files reported are copies
+// with the directives resolved, in the output base.
+func (fp *FlatPackage) ExpandCgoFiles(prf PathResolverFunc, typecheckCgo bool) {
+	if fp.cgoSrcsDir == "" {
+		return
+	}
+	entries, err := ioutil.ReadDir(fp.cgoSrcsDir)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(fp.cgoSrcsDir))
+	outDir := prf(filepath.Join("__BAZEL_OUTPUT_BASE__", "gopackagesdriver_cgo", hex.EncodeToString(sum[:8])))
+	var cgoTypes string
+	genFiles := map[string]string{}
+	for _, e := range entries {
+		path, err := resolveLineDirectives(filepath.Join(fp.cgoSrcsDir, e.Name()), outDir, prf)
+		if err != nil {
+			return
+		}
+		if e.Name() == "_cgo_gotypes.go" {
+			cgoTypes = path
+		} else if strings.HasSuffix(e.Name(), ".cgo1.go") {
+			genFiles[strings.TrimSuffix(e.Name(), ".cgo1.go")+".go"] = path
+		}
+	}
+	if cgoTypes == "" {
+		return
+	}
+
+	var goFiles, cgoFiles []string
+	for _, f := range fp.CompiledGoFiles {
+		if !strings.HasSuffix(f, ".go") {
+			// C sources and headers are compiled along with cgo files.
+			fp.addOtherFile(f)
+			continue
+		}
+		if genFile, ok := genFiles[filepath.Base(f)]; ok && !typecheckCgo {
+			cgoFiles = append(cgoFiles, genFile)
+			continue
+		}
+		goFiles = append(goFiles, f)
+	}
+	if typecheckCgo {
+		fp.CompiledGoFiles = append([]string{cgoTypes}, goFiles...)
+	} else {
+		fp.CompiledGoFiles = append(append(goFiles, cgoTypes), cgoFiles...)
+	}
+}
+
+// resolveLineDirectives copies the file at path to dir, with the
+// placeholders in the files of its //line directives resolved by prf, and
+// returns the path of the copy. The copy is only written if it changed, so
+// that editors don't see it change on every request.
+func resolveLineDirectives(path, dir string, prf PathResolverFunc) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	const prefix = "//line __BAZEL_"
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		pos := line[len("//line "):]
+		end := len(pos)
+		for n := 0; n < 2 && end >= 0; n++ {
+			end = strings.LastIndex(pos[:end], ":")
+		}
+		if end < 0 {
+			continue
+		}
+		lines[i] = "//line " + prf(filepath.FromSlash(pos[:end])) + pos[end:]
+	}
+	resolved := []byte(strings.Join(lines, "\n"))
+
+	out := filepath.Join(dir, filepath.Base(path))
+	if old, err := ioutil.ReadFile(out); err == nil && bytes.Equal(old, resolved) {
+		return out, nil
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(out, resolved, 0666); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+func (fp *FlatPackage) addOtherFile(file string) {
+	for _, f := range fp.OtherFiles {
+		if f == file {
+			return
+		}
+	}
+	fp.OtherFiles = append(fp.OtherFiles, file)
+}
+
+// FilterFilesForBuildTags filters the source files given the build tags of
+// the configuration the package was built in, or of config if the package
+// doesn't record it.
+func (fp *FlatPackage) FilterFilesForBuildTags(config *BuildConfig) {
+	if fp.config != nil {
+		config = fp.config
+	}
+	bctx := config.context()
+	fp.GoFiles = filterSourceFilesForTags(bctx, fp.GoFiles)
+	fp.CompiledGoFiles = filterSourceFilesForTags(bctx, fp.CompiledGoFiles)
 }
 
 func (fp *FlatPackage) IsStdlib() bool {
 	return fp.Standard
 }
 
-func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc) {
+func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc, overlay Overlay) {
 	// Stdlib packages are already complete import wise
 	if fp.IsStdlib() {
 		return
@@ -122,7 +320,7 @@ func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc) {
 	fset := token.NewFileSet()
 
 	for _, file := range fp.CompiledGoFiles {
-		f, err := parser.ParseFile(fset, file, nil, parser.ImportsOnly)
+		f, err := overlay.parseFile(fset, file, parser.ImportsOnly)
 		if err != nil {
 			continue
 		}
@@ -152,6 +350,91 @@ func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc) {
 	}
 }
 
+// AddOverlayFile adds a Go file that only exists in the overlay, or that
+// isn't listed in any BUILD file yet, to the package.
+func (fp *FlatPackage) AddOverlayFile(file string) {
+	for _, f := range fp.GoFiles {
+		if f == file {
+			return
+		}
+	}
+	fp.GoFiles = append(fp.GoFiles, file)
+	fp.CompiledGoFiles = append(fp.CompiledGoFiles, file)
+}
+
+// packageName returns the name of the package declared in the Go files of
+// fp, reading the first file that can be parsed.
+func (fp *FlatPackage) packageName(overlay Overlay) string {
+	if fp.Name != "" {
+		return fp.Name
+	}
+	fset := token.NewFileSet()
+	for _, file := range fp.GoFiles {
+		if f, err := overlay.parseFile(fset, file, parser.PackageClauseOnly); err == nil {
+			return f.Name.Name
+		}
+	}
+	return ""
+}
+
+func (fp *FlatPackage) hasFileInDir(dir string) bool {
+	for _, f := range fp.GoFiles {
+		if filepath.Dir(f) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (fp *FlatPackage) hasTestFiles() bool {
+	for _, f := range fp.GoFiles {
+		if strings.HasSuffix(f, "_test.go") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTest returns whether fp was compiled for a go_test: the package under
+// test with its internal tests, the external test package, the generated
+// main package, or a dependency recompiled against the package under test.
+// Their IDs end with the test suffix returned by TestSuffix.
+func (fp *FlatPackage) IsTest() bool {
+	return fp.ForTest != "" || fp.IsTestMain()
+}
+
+// IsTestMain returns whether fp is the main package generated for a go_test.
+func (fp *FlatPackage) IsTestMain() bool {
+	return strings.HasSuffix(fp.ID, ".test") && strings.HasSuffix(fp.PkgPath, ".test")
+}
+
+// TestSuffix returns the suffix shared by the IDs of the packages compiled
+// for the same go_test as fp, like " [//foo:foo_test.test]", or "" if fp is
+// not a test package.
+func (fp *FlatPackage) TestSuffix() string {
+	if fp.IsTestMain() {
+		return " [" + fp.ID + "]"
+	}
+	if fp.ForTest == "" {
+		return ""
+	}
+	if i := strings.LastIndex(fp.ID, " ["); i >= 0 {
+		return fp.ID[i:]
+	}
+	return ""
+}
+
+// Label returns the label of the target fp was built for.
+func (fp *FlatPackage) Label() string {
+	if fp.IsTestMain() {
+		return strings.TrimSuffix(fp.ID, ".test")
+	}
+	if suffix := fp.TestSuffix(); suffix != "" {
+		return strings.TrimSuffix(strings.TrimPrefix(suffix, " ["), ".test]")
+	}
+	return fp.ID
+}
+
 func (fp *FlatPackage) IsRoot() bool {
 	return strings.HasPrefix(fp.ID, "//")
 }
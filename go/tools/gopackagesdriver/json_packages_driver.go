@@ -16,14 +16,13 @@ package main
 
 import (
 	"fmt"
-	"go/types"
 )
 
 type JSONPackagesDriver struct {
 	registry *PackageRegistry
 }
 
-func NewJSONPackagesDriver(jsonFiles []string, prf PathResolverFunc) (*JSONPackagesDriver, error) {
+func NewJSONPackagesDriver(jsonFiles []string, prf PathResolverFunc, overlay Overlay, mode LoadMode) (*JSONPackagesDriver, error) {
 	jpd := &JSONPackagesDriver{
 		registry: NewPackageRegistry(),
 	}
@@ -40,19 +39,33 @@ func NewJSONPackagesDriver(jsonFiles []string, prf PathResolverFunc) (*JSONPacka
 		return nil, fmt.Errorf("unable to resolve paths: %w", err)
 	}
 
-	if err := jpd.registry.ResolveImports(); err != nil {
+	jpd.registry.ExpandCgoFiles(prf, mode&typecheckCgo != 0)
+
+	if mode&(NeedEmbedFiles|NeedEmbedPatterns) != 0 {
+		jpd.registry.ReadEmbedFiles(prf)
+	}
+
+	jpd.registry.ApplyOverlay(overlay)
+
+	if err := jpd.registry.ResolveImports(overlay); err != nil {
 		return nil, fmt.Errorf("unable to resolve paths: %w", err)
 	}
 
 	return jpd, nil
 }
 
-func (b *JSONPackagesDriver) Match(pattern ...string) *driverResponse {
-	rootPkgs, packages := b.registry.Match(pattern...)
+// SetModules sets the modules of the packages. See
+// PackageRegistry.SetModules.
+func (b *JSONPackagesDriver) SetModules(modules *Modules) {
+	b.registry.SetModules(modules)
+}
+
+func (b *JSONPackagesDriver) Match(tests bool, pattern ...string) *driverResponse {
+	rootPkgs, packages := b.registry.Match(tests, pattern...)
 
 	return &driverResponse{
 		NotHandled: false,
-		Sizes:      types.SizesFor("gc", "amd64").(*types.StdSizes),
+		Sizes:      b.registry.Config().Sizes(),
 		Roots:      rootPkgs,
 		Packages:   packages,
 	}
@@ -0,0 +1,259 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const (
+	stdlibFmt     = "@io_bazel_rules_go//stdlib:fmt"
+	stdlibStrings = "@io_bazel_rules_go//stdlib:strings"
+)
+
+// recordedQueries are the outputs of the queries run for the patterns of
+// the tests, in the workspace in testdata/workspace.
+var recordedQueries = map[string]string{
+	`@io_bazel_rules_go//:stdlib`: `@io_bazel_rules_go//:stdlib`,
+	`kind("go_library", attr(importpath, "^example.com/repo(/.+)?$", deps(//...)))`: "//bar:bar\n//foo:foo",
+	`kind("go_library", attr(importpath, "example.com/repo/bar", deps(//...)))`:     "//bar:bar",
+	`kind("go_library|go_test", same_pkg_direct_rdeps("foo/foo.go"))`:               "//foo:foo",
+	`kind("go_library|go_test", same_pkg_direct_rdeps("bar/bar.go"))`:               "//bar:bar",
+	`kind("go_library", //foo:all)`:                                                 "//foo:foo",
+}
+
+// loadPackages answers a request for patterns like run does, with Bazel
+// replaying the recorded outputs.
+func loadPackages(t *testing.T, overlay Overlay, patterns ...string) (*driverResponse, *fakeBazel) {
+	t.Helper()
+	bazel := newFakeBazel(t, recordedQueries)
+	setGlobals(t, bazel.WorkspaceRoot(), "//...")
+
+	b, err := NewBazelJSONBuilder(bazel, overlay, false, patterns...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFiles, err := b.Build(context.Background(), NeedName|NeedFiles|NeedImports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver, err := NewJSONPackagesDriver(jsonFiles, b.PathResolver(), overlay, NeedName|NeedFiles|NeedImports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return driver.Match(false, patterns...), bazel
+}
+
+func TestMatch(t *testing.T) {
+	barFile, err := filepath.Abs("testdata/workspace/bar/bar.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc      string
+		patterns  []string
+		wantRoots []string
+		wantBuild string
+	}{
+		{
+			desc:      "std",
+			patterns:  []string{"std"},
+			wantRoots: []string{stdlibFmt, stdlibStrings},
+			wantBuild: "build @io_bazel_rules_go//:stdlib",
+		},
+		{
+			desc:      "import_path",
+			patterns:  []string{"example.com/repo/bar"},
+			wantRoots: []string{"//bar:bar"},
+			wantBuild: "build //bar:bar",
+		},
+		{
+			desc:      "recursive",
+			patterns:  []string{"example.com/repo/..."},
+			wantRoots: []string{"//bar:bar", "//foo:foo"},
+			wantBuild: "build //bar:bar //foo:foo",
+		},
+		{
+			desc:      "relative_file",
+			patterns:  []string{"file=foo/foo.go"},
+			wantRoots: []string{"//foo:foo"},
+			wantBuild: "build //foo:foo",
+		},
+		{
+			desc:      "absolute_file",
+			patterns:  []string{"file=" + barFile},
+			wantRoots: []string{"//bar:bar"},
+			wantBuild: "build //bar:bar",
+		},
+		{
+			desc:      "bazel_package",
+			patterns:  []string{"//foo:all"},
+			wantRoots: []string{"//foo:foo"},
+			wantBuild: "build //foo:foo",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp, bazel := loadPackages(t, Overlay{}, tc.patterns...)
+			roots := append([]string{}, resp.Roots...)
+			sort.Strings(roots)
+			if !reflect.DeepEqual(roots, tc.wantRoots) {
+				t.Errorf("got roots %q, want %q", roots, tc.wantRoots)
+			}
+			if got := bazel.ran[len(bazel.ran)-1]; got != tc.wantBuild {
+				t.Errorf("got command %q, want %q", got, tc.wantBuild)
+			}
+		})
+	}
+}
+
+func TestResolveImports(t *testing.T) {
+	fooFile, err := filepath.Abs("testdata/workspace/foo/foo.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		overlay     Overlay
+		wantImports map[string]map[string]string
+	}{
+		{
+			desc: "sources",
+			wantImports: map[string]map[string]string{
+				"//foo:foo": {
+					"fmt":                  stdlibFmt,
+					"example.com/repo/bar": "//bar:bar",
+				},
+				// C is not a package, and packages outside of the
+				// request are left out.
+				"//bar:bar": {
+					"strings": stdlibStrings,
+				},
+				stdlibFmt: {
+					"strings": stdlibStrings,
+				},
+				stdlibStrings: nil,
+			},
+		},
+		{
+			desc: "overlay",
+			overlay: Overlay{
+				fooFile: []byte("package foo\n\nimport \"strings\"\n"),
+			},
+			// foo no longer imports bar or fmt in the overlay.
+			wantImports: map[string]map[string]string{
+				"//foo:foo": {
+					"strings": stdlibStrings,
+				},
+				"//bar:bar": {
+					"strings": stdlibStrings,
+				},
+				stdlibStrings: nil,
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp, _ := loadPackages(t, tc.overlay, "example.com/repo/...")
+			gotImports := map[string]map[string]string{}
+			for _, pkg := range resp.Packages {
+				gotImports[pkg.ID] = pkg.Imports
+			}
+			if !reflect.DeepEqual(gotImports, tc.wantImports) {
+				t.Errorf("got imports %v, want %v", gotImports, tc.wantImports)
+			}
+		})
+	}
+}
+
+func TestStdlibPackages(t *testing.T) {
+	resp, _ := loadPackages(t, Overlay{}, "std")
+	ws := newFakeBazel(t, nil)
+	want := map[string]*FlatPackage{
+		stdlibFmt: {
+			ID:              stdlibFmt,
+			Name:            "fmt",
+			PkgPath:         "fmt",
+			ExportFile:      filepath.Join(ws.OutputBase(), "external/go_sdk/pkg/linux_amd64/fmt.a"),
+			GoFiles:         []string{filepath.Join(ws.OutputBase(), "external/go_sdk/src/fmt/print.go")},
+			CompiledGoFiles: []string{filepath.Join(ws.OutputBase(), "external/go_sdk/src/fmt/print.go")},
+			Imports:         map[string]string{"strings": stdlibStrings},
+			Standard:        true,
+		},
+		stdlibStrings: {
+			ID:              stdlibStrings,
+			Name:            "strings",
+			PkgPath:         "strings",
+			ExportFile:      filepath.Join(ws.OutputBase(), "external/go_sdk/pkg/linux_amd64/strings.a"),
+			GoFiles:         []string{filepath.Join(ws.OutputBase(), "external/go_sdk/src/strings/strings.go")},
+			CompiledGoFiles: []string{filepath.Join(ws.OutputBase(), "external/go_sdk/src/strings/strings.go")},
+			Standard:        true,
+		},
+	}
+	if len(resp.Packages) != len(want) {
+		t.Errorf("got %d packages, want %d", len(resp.Packages), len(want))
+	}
+	for _, pkg := range resp.Packages {
+		if !reflect.DeepEqual(pkg, want[pkg.ID]) {
+			t.Errorf("got package:\n%+v\nwant:\n%+v", pkg, want[pkg.ID])
+		}
+	}
+}
+
+func TestInternalOnlyTest(t *testing.T) {
+	const query = `kind("go_library", attr(importpath, "example.com/repo/foo", deps(//...)))`
+	bazel := newFakeBazel(t, map[string]string{
+		query + ` union kind("go_test", rdeps(//..., ` + query + `, 1))`: "//foo:foo\n//foo:foo_test",
+	})
+	// foo_test has internal tests only, so the aspect outputs the package
+	// under test and the main package, but no external test package.
+	bep, err := ioutil.ReadFile("testdata/bep_tests.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bazel.bep = string(bep)
+	setGlobals(t, bazel.WorkspaceRoot(), "//...")
+
+	b, err := NewBazelJSONBuilder(bazel, Overlay{}, true, "example.com/repo/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFiles, err := b.Build(context.Background(), NeedName|NeedFiles|NeedImports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver, err := NewJSONPackagesDriver(jsonFiles, b.PathResolver(), Overlay{}, NeedName|NeedFiles|NeedImports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := driver.Match(true, "example.com/repo/foo")
+
+	roots := append([]string{}, resp.Roots...)
+	sort.Strings(roots)
+	wantRoots := []string{"//foo:foo", "//foo:foo [//foo:foo_test.test]", "//foo:foo_test.test"}
+	if !reflect.DeepEqual(roots, wantRoots) {
+		t.Errorf("got roots %q, want %q", roots, wantRoots)
+	}
+	for _, pkg := range resp.Packages {
+		if pkg.ID == "//foo:foo [//foo:foo_test.test]" && pkg.Imports["example.com/repo/bar"] != "//bar:bar" {
+			t.Errorf("got imports %v for %s, want example.com/repo/bar from //bar:bar", pkg.Imports, pkg.ID)
+		}
+	}
+}
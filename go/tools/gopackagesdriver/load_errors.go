@@ -0,0 +1,120 @@
+// Copyright 2023 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// withLoadError reports err, which made Bazel fail to load the packages
+// matching patterns, in a copy of resp so that editors can show it. The
+// packages of the targets that failed carry the error, and a package is
+// added for each pattern that didn't match any package, since there is
+// nothing else to attach the error to.
+func withLoadError(resp *driverResponse, err error, patterns []string) *driverResponse {
+	ret := *resp
+	ret.Roots = append([]string{}, resp.Roots...)
+	ret.Packages = append([]*FlatPackage{}, resp.Packages...)
+
+	listErr := FlatPackagesError{
+		Pos:  "-",
+		Msg:  err.Error(),
+		Kind: ListError,
+	}
+
+	var bazelErr *BazelError
+	failed := map[string]bool{}
+	if errors.As(err, &bazelErr) {
+		for _, label := range bazelErr.Targets {
+			failed[label] = true
+		}
+	}
+	for i, pkg := range ret.Packages {
+		if !failed[pkg.Label()] {
+			continue
+		}
+		// Packages may be shared with a registry that outlives the
+		// response.
+		errPkg := *pkg
+		errPkg.Errors = append(append([]FlatPackagesError{}, pkg.Errors...), listErr)
+		ret.Packages[i] = &errPkg
+	}
+
+	roots := map[string]*FlatPackage{}
+	for _, id := range ret.Roots {
+		roots[id] = nil
+	}
+	for _, pkg := range ret.Packages {
+		if _, ok := roots[pkg.ID]; ok {
+			roots[pkg.ID] = pkg
+		}
+	}
+	for _, pattern := range patterns {
+		if patternMatched(pattern, roots) {
+			continue
+		}
+		pkg := errorPackage(pattern, listErr)
+		ret.Roots = append(ret.Roots, pkg.ID)
+		ret.Packages = append(ret.Packages, pkg)
+	}
+	return &ret
+}
+
+// patternMatched returns whether any of roots matches pattern.
+func patternMatched(pattern string, roots map[string]*FlatPackage) bool {
+	switch {
+	case pattern == "." || pattern == "./..." || isBazelPackagePattern(pattern) || pattern == "std" || pattern == "builtin" || strings.HasSuffix(pattern, "/..."):
+		return len(roots) > 0
+	case strings.HasPrefix(pattern, "file="):
+		f := ensureAbsolutePathFromWorkspace(strings.TrimPrefix(pattern, "file="))
+		for _, pkg := range roots {
+			if pkg == nil {
+				continue
+			}
+			for _, src := range concatStringsArrays(pkg.GoFiles, pkg.CompiledGoFiles, pkg.OtherFiles) {
+				if src == f {
+					return true
+				}
+			}
+		}
+		return false
+	default:
+		for _, pkg := range roots {
+			if pkg != nil && pkg.PkgPath == pattern {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// errorPackage returns a package that only reports err, for a pattern that
+// could not be loaded. Packages for files contain the file, so that the
+// error is shown on it.
+func errorPackage(pattern string, err FlatPackagesError) *FlatPackage {
+	pkg := &FlatPackage{
+		ID:     pattern,
+		Errors: []FlatPackagesError{err},
+	}
+	if strings.HasPrefix(pattern, "file=") {
+		f := ensureAbsolutePathFromWorkspace(strings.TrimPrefix(pattern, "file="))
+		pkg.GoFiles = []string{f}
+		pkg.CompiledGoFiles = []string{f}
+	} else {
+		pkg.PkgPath = pattern
+	}
+	return pkg
+}
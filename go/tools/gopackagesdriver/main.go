@@ -21,6 +21,7 @@ import (
 	"go/types"
 	"os"
 	"strings"
+	"time"
 )
 
 type driverResponse struct {
@@ -58,9 +59,13 @@ var (
 	bazelQueryScope       = getenvDefault("GOPACKAGESDRIVER_BAZEL_QUERY_SCOPE", "")
 	bazelBuildFlags       = strings.Fields(os.Getenv("GOPACKAGESDRIVER_BAZEL_BUILD_FLAGS"))
 	workspaceRoot         = os.Getenv("BUILD_WORKSPACE_DIRECTORY")
+	daemonMode            = os.Getenv("GOPACKAGESDRIVER_DAEMON") != ""
+	daemonSocket          = os.Getenv("GOPACKAGESDRIVER_DAEMON_SOCKET")
+	daemonIdleTimeout     = getenvDuration("GOPACKAGESDRIVER_DAEMON_IDLE_TIMEOUT", 3*time.Hour)
+	cacheDisabled         = os.Getenv("GOPACKAGESDRIVER_NO_CACHE") != ""
 	emptyResponse         = &driverResponse{
 		NotHandled: false,
-		Sizes:      types.SizesFor("gc", "amd64").(*types.StdSizes),
+		Sizes:      sizesFor(buildContext.GOARCH),
 		Roots:      []string{},
 		Packages:   []*FlatPackage{},
 	}
@@ -71,6 +76,11 @@ func run() (*driverResponse, error) {
 	defer cancel()
 
 	queries := os.Args[1:]
+	if wd, err := os.Getwd(); err == nil {
+		// Relative patterns only match the packages in the directory of
+		// the caller, like with the go command.
+		queries = resolveRelativePatterns(wd, queries)
+	}
 
 	request, err := ReadDriverRequest(os.Stdin)
 	if err != nil {
@@ -82,26 +92,105 @@ func run() (*driverResponse, error) {
 		return emptyResponse, fmt.Errorf("unable to create bazel instance: %w", err)
 	}
 
-	bazelJsonBuilder, err := NewBazelJSONBuilder(bazel, queries...)
+	// Unsaved editor buffers are used when filtering files for build tags
+	// and resolving imports.
+	overlay := NewOverlay(request.Overlay)
+	buildContext.OpenFile = overlay.OpenFile
+
+	bazelJsonBuilder, err := NewBazelJSONBuilder(bazel, overlay, request.Tests, queries...)
 	if err != nil {
 		return emptyResponse, fmt.Errorf("unable to build JSON files: %w", err)
 	}
 
-	jsonFiles, err := bazelJsonBuilder.Build(ctx, request.Mode)
-	if err != nil {
-		return emptyResponse, fmt.Errorf("unable to build JSON files: %w", err)
+	// Identical requests are answered from the files built the previous
+	// time, as long as the BUILD and .bzl files they depend on are
+	// unchanged.
+	cache := newResponseCache(bazel)
+	cacheKey := cache.key(bazelJsonBuilder.Query(), request.Mode)
+	entry := cache.get(cacheKey)
+
+	var labels, jsonFiles []string
+	var buildErr error
+	if entry != nil {
+		jsonFiles = entry.JSONFiles
+	} else {
+		labels, err = bazelJsonBuilder.Labels(ctx)
+		if err != nil {
+			return withLoadError(emptyResponse, err, queries), fmt.Errorf("unable to build JSON files: %w", err)
+		}
+		// If some targets fail to build, still return the packages that
+		// could be loaded, with the error.
+		jsonFiles, buildErr = bazelJsonBuilder.BuildLabels(ctx, request.Mode, labels)
+		if buildErr != nil && len(jsonFiles) == 0 {
+			return withLoadError(emptyResponse, buildErr, queries), fmt.Errorf("unable to build JSON files: %w", buildErr)
+		}
 	}
 
-	driver, err := NewJSONPackagesDriver(jsonFiles, bazelJsonBuilder.PathResolver())
+	driver, err := NewJSONPackagesDriver(jsonFiles, bazelJsonBuilder.PathResolver(), overlay, request.Mode)
 	if err != nil {
-		return emptyResponse, fmt.Errorf("unable to load JSON files: %w", err)
+		return withLoadError(emptyResponse, err, queries), fmt.Errorf("unable to load JSON files: %w", err)
+	}
+
+	// Finding modules runs a query, so they are cached too. An entry made
+	// without them gets them the first time they are requested.
+	var modules *Modules
+	if entry != nil {
+		modules = entry.Modules
+	}
+	if request.Mode&NeedModule != 0 {
+		if modules == nil {
+			modules = bazelJsonBuilder.Modules(ctx)
+			if entry != nil {
+				entry.Modules = modules
+				cache.put(cacheKey, entry)
+			}
+		}
+		driver.SetModules(modules)
 	}
 
-	return driver.Match(queries...), nil
+	if entry == nil && buildErr == nil {
+		cache.put(cacheKey, &cacheEntry{
+			Patterns:  queries,
+			Query:     bazelJsonBuilder.Query(),
+			Labels:    labels,
+			JSONFiles: jsonFiles,
+			Modules:   modules,
+			Files:     cacheDependencies(driver.registry, bazelJsonBuilder.Query(), request.Mode&cachedOutputs != 0),
+			Recursive: recursiveDependencies(bazelJsonBuilder.Query()),
+			Created:   time.Now(),
+		})
+	}
+
+	response := driver.Match(request.Tests, queries...)
+	if buildErr != nil {
+		return withLoadError(response, buildErr, queries), fmt.Errorf("unable to build JSON files: %w", buildErr)
+	}
+	return response, nil
 }
 
 func main() {
-	response, err := run()
+	if len(os.Args) == 2 && os.Args[1] == serveArg {
+		if err := serve(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == cacheArg {
+		if err := runCacheCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var response *driverResponse
+	var err error
+	if daemonMode {
+		response, err = runClient()
+	} else {
+		response, err = run()
+	}
 	if err := json.NewEncoder(os.Stdout).Encode(response); err != nil {
 		fmt.Fprintf(os.Stderr, "unable to encode response: %v", err)
 	}
@@ -0,0 +1,295 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Copy and pasted from golang.org/x/tools/go/packages
+type Module struct {
+	Path      string  // module path
+	Version   string  // module version
+	Replace   *Module // replaced by this module
+	Main      bool    // is this the main module?
+	Indirect  bool    // is this module only an indirect dependency of main module?
+	Dir       string  // directory holding files for this module, if any
+	GoMod     string  // path to go.mod file used when loading this module, if any
+	GoVersion string  // go version used in module
+}
+
+// Modules maps the repositories of the workspace to the Go modules they
+// contain. The main workspace is the main module, if it has a go.mod file,
+// and external repositories are the modules fetched by go_repository rules.
+type Modules struct {
+	main       *Module
+	outputBase string
+	// byRepo maps the apparent names of go_repository rules to their
+	// module.
+	byRepo map[string]*Module
+}
+
+// modulesJSON is the JSON encoding of Modules, which is stored in the
+// response cache.
+type modulesJSON struct {
+	Main       *Module            `json:",omitempty"`
+	OutputBase string             `json:",omitempty"`
+	ByRepo     map[string]*Module `json:",omitempty"`
+}
+
+func (m *Modules) MarshalJSON() ([]byte, error) {
+	return json.Marshal(modulesJSON{
+		Main:       m.main,
+		OutputBase: m.outputBase,
+		ByRepo:     m.byRepo,
+	})
+}
+
+func (m *Modules) UnmarshalJSON(data []byte) error {
+	var mj modulesJSON
+	if err := json.Unmarshal(data, &mj); err != nil {
+		return err
+	}
+	m.main = mj.Main
+	m.outputBase = mj.OutputBase
+	m.byRepo = mj.ByRepo
+	return nil
+}
+
+var buildAttrRegexp = regexp.MustCompile(`^\s*(\w+) = (".*"),?$`)
+
+// Modules returns the modules of the workspace. External modules are
+// found by querying the go_repository rules declared in the WORKSPACE file.
+// With Bzlmod, //external has no go_repository rules, so they are the
+// requirements of the go.mod file of the main module, which the go_deps
+// extension of Gazelle creates repositories for, named after their module
+// paths. Modules declared with go_deps.module tags only are not found.
+// Errors are ignored, since a workspace may not use modules at all.
+func (b *BazelJSONBuilder) Modules(ctx context.Context) *Modules {
+	m := &Modules{
+		main:       readGoMod(filepath.Join(b.bazel.WorkspaceRoot(), "go.mod")),
+		outputBase: b.bazel.OutputBase(),
+		byRepo:     map[string]*Module{},
+	}
+	if m.main != nil {
+		m.main.Main = true
+		m.main.Dir = b.bazel.WorkspaceRoot()
+	}
+
+	queryArgs := concatStringsArrays(bazelFlags, bazelQueryFlags, []string{
+		"--ui_event_filters=-info,-stderr",
+		"--noshow_progress",
+		"--output=build",
+		"kind(go_repository, //external:*)",
+	})
+	lines, err := b.bazel.Query(ctx, queryArgs...)
+	if err != nil {
+		lines = nil
+	}
+	var attrs map[string]string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "go_repository(") {
+			attrs = map[string]string{}
+			continue
+		}
+		if attrs == nil {
+			continue
+		}
+		if strings.HasPrefix(line, ")") {
+			m.addRepository(attrs)
+			attrs = nil
+			continue
+		}
+		if match := buildAttrRegexp.FindStringSubmatch(line); match != nil {
+			if value, err := strconv.Unquote(match[2]); err == nil {
+				attrs[match[1]] = value
+			}
+		}
+	}
+	if len(m.byRepo) == 0 && m.main != nil {
+		m.addGoModRequirements(m.main.GoMod)
+	}
+	return m
+}
+
+func (m *Modules) addRepository(attrs map[string]string) {
+	if attrs["name"] == "" || attrs["importpath"] == "" {
+		return
+	}
+	version := attrs["version"]
+	if version == "" {
+		version = attrs["tag"]
+	}
+	mod := &Module{Path: attrs["importpath"], Version: version}
+	if attrs["replace"] != "" {
+		mod.Replace = &Module{Path: attrs["replace"], Version: version}
+	}
+	m.byRepo[attrs["name"]] = mod
+}
+
+// addGoModRequirements adds the modules required by the go.mod file at
+// path, with the repository names go_deps gives them.
+func (m *Modules) addGoModRequirements(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var requires []*Module
+	replaces := map[string]*Module{}
+	block := "" // the directive of the block being read, like "require"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		directive := block
+		switch {
+		case block != "" && fields[0] == ")":
+			block = ""
+			continue
+		case block != "":
+		case len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+			continue
+		default:
+			directive, fields = fields[0], fields[1:]
+		}
+		switch directive {
+		case "require":
+			if len(fields) >= 2 {
+				requires = append(requires, &Module{Path: unquote(fields[0]), Version: fields[1]})
+			}
+		case "replace":
+			// Only replacements by modules are fetched; replacements by
+			// directories are not go_deps repositories.
+			for i, field := range fields {
+				if field == "=>" && len(fields) == i+3 {
+					replaces[unquote(fields[0])] = &Module{Path: unquote(fields[i+1]), Version: fields[i+2]}
+				}
+			}
+		}
+	}
+	for _, mod := range requires {
+		mod.Replace = replaces[mod.Path]
+		m.byRepo[goRepositoryName(mod.Path)] = mod
+	}
+}
+
+// goRepositoryName returns the name Gazelle gives to the repository of the
+// module at path, like "com_github_foo_bar" for "github.com/foo/bar".
+func goRepositoryName(path string) string {
+	parts := strings.Split(strings.ToLower(path), "/")
+	host := strings.Split(parts[0], ".")
+	for i, j := 0, len(host)-1; i < j; i, j = i+1, j-1 {
+		host[i], host[j] = host[j], host[i]
+	}
+	name := strings.Join(append(host, parts[1:]...), "_")
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// unquote returns s unquoted if it's a quoted string, or s otherwise.
+func unquote(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// ForRepo returns the module of the packages in repo, or nil if the
+// repository doesn't contain a module.
+func (m *Modules) ForRepo(repo string) *Module {
+	if m == nil {
+		return nil
+	}
+	if repo == "" {
+		return m.main
+	}
+	mod, ok := m.byRepo[apparentRepoName(repo)]
+	if !ok {
+		return nil
+	}
+	dir := filepath.Join(m.outputBase, "external", repo)
+	ret := *mod
+	ret.Dir = dir
+	if modFile := readGoMod(filepath.Join(dir, "go.mod")); modFile != nil {
+		ret.GoMod = filepath.Join(dir, "go.mod")
+		ret.GoVersion = modFile.GoVersion
+	}
+	if ret.Replace != nil {
+		replace := *ret.Replace
+		replace.Dir = ret.Dir
+		replace.GoMod = ret.GoMod
+		replace.GoVersion = ret.GoVersion
+		ret.Replace = &replace
+	}
+	return &ret
+}
+
+// apparentRepoName strips the prefix Bazel adds to the names of the
+// repositories created by module extensions, like "gazelle~~go_deps~".
+func apparentRepoName(repo string) string {
+	if i := strings.LastIndexAny(repo, "~+"); i >= 0 {
+		return repo[i+1:]
+	}
+	return repo
+}
+
+// readGoMod reads the module path and the go version of a go.mod file. It
+// returns nil if the file can't be read or doesn't declare a module.
+func readGoMod(path string) *Module {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	mod := &Module{GoMod: path}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "module":
+			mod.Path = unquote(fields[1])
+		case "go":
+			mod.GoVersion = fields[1]
+		}
+	}
+	if mod.Path == "" {
+		return nil
+	}
+	return mod
+}
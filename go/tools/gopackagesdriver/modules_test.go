@@ -0,0 +1,83 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestBzlmodModules(t *testing.T) {
+	// With Bzlmod, there is no go_repository in //external, so the query
+	// has no recorded output and fails.
+	bazel := newFakeBazel(t, nil)
+	bazel.workspaceRoot = t.TempDir()
+	goMod := `module example.com/repo
+
+go 1.21
+
+require github.com/foo/bar v1.2.3 // indirect
+
+require (
+	gopkg.in/yaml.v3 v3.0.1
+	example.com/Old v0.1.0
+)
+
+replace (
+	example.com/Old => example.com/new v0.2.0
+	gopkg.in/yaml.v3 => ./third_party/yaml
+)
+`
+	if err := ioutil.WriteFile(filepath.Join(bazel.workspaceRoot, "go.mod"), []byte(goMod), 0666); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBazelJSONBuilder(bazel, Overlay{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := b.Modules(context.Background())
+
+	if mod := modules.ForRepo(""); mod == nil || mod.Path != "example.com/repo" || !mod.Main {
+		t.Errorf("got main module %+v, want example.com/repo", mod)
+	}
+	for _, tc := range []struct {
+		repo, path, version, replace string
+	}{
+		{repo: "gazelle~~go_deps~com_github_foo_bar", path: "github.com/foo/bar", version: "v1.2.3"},
+		{repo: "gazelle++go_deps+in_gopkg_yaml_v3", path: "gopkg.in/yaml.v3", version: "v3.0.1"},
+		{repo: "gazelle~~go_deps~com_example_old", path: "example.com/Old", version: "v0.1.0", replace: "example.com/new"},
+	} {
+		mod := modules.ForRepo(tc.repo)
+		if mod == nil {
+			t.Errorf("%s: got no module, want %s", tc.repo, tc.path)
+			continue
+		}
+		if mod.Path != tc.path || mod.Version != tc.version {
+			t.Errorf("%s: got module %s@%s, want %s@%s", tc.repo, mod.Path, mod.Version, tc.path, tc.version)
+		}
+		if want := filepath.Join(bazel.OutputBase(), "external", tc.repo); mod.Dir != want {
+			t.Errorf("%s: got directory %s, want %s", tc.repo, mod.Dir, want)
+		}
+		var replace string
+		if mod.Replace != nil {
+			replace = mod.Replace.Path
+		}
+		if replace != tc.replace {
+			t.Errorf("%s: got replacement %q, want %q", tc.repo, replace, tc.replace)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Overlay maps absolute file paths to the contents of unsaved editor
+// buffers. Files in the overlay may not exist on disk yet.
+type Overlay map[string][]byte
+
+// NewOverlay returns an Overlay for the overlay in a driver request. Paths
+// in the request are relative to the driver's working directory.
+func NewOverlay(files map[string][]byte) Overlay {
+	overlay := make(Overlay, len(files))
+	for path, contents := range files {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		overlay[filepath.Clean(path)] = contents
+	}
+	return overlay
+}
+
+// Files returns the sorted paths of the files in the overlay.
+func (o Overlay) Files() []string {
+	files := make([]string, 0, len(o))
+	for path := range o {
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// OpenFile opens path, reading from the overlay if possible. It can be used
+// as build.Context.OpenFile.
+func (o Overlay) OpenFile(path string) (io.ReadCloser, error) {
+	if contents, ok := o[path]; ok {
+		return ioutil.NopCloser(bytes.NewReader(contents)), nil
+	}
+	return os.Open(path)
+}
+
+// parseFile parses the package clause and the imports of a Go file, using
+// its overlay contents if there are any.
+func (o Overlay) parseFile(fset *token.FileSet, path string, mode parser.Mode) (*ast.File, error) {
+	var src interface{}
+	if contents, ok := o[path]; ok {
+		src = contents
+	}
+	return parser.ParseFile(fset, path, src, mode)
+}
+
+// Imports returns the import paths used by the Go files in the overlay.
+func (o Overlay) Imports() []string {
+	fset := token.NewFileSet()
+	seen := map[string]bool{}
+	var imports []string
+	for _, path := range o.Files() {
+		if filepath.Ext(path) != ".go" {
+			continue
+		}
+		f, err := o.parseFile(fset, path, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, rawImport := range f.Imports {
+			imp, err := strconv.Unquote(rawImport.Path.Value)
+			if err != nil || seen[imp] {
+				continue
+			}
+			seen[imp] = true
+			imports = append(imports, imp)
+		}
+	}
+	return imports
+}
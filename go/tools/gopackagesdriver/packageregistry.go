@@ -15,20 +15,29 @@
 package main
 
 import (
+	"go/parser"
+	"go/token"
+	"path/filepath"
 	"strings"
 )
 
 type PackageRegistry struct {
 	packagesByID         map[string]*FlatPackage
 	packagesByImportPath map[string]*FlatPackage
-	packagesByFile       map[string]*FlatPackage
+	// packagesByFile maps each file to the packages compiled from it. A
+	// library's files are also compiled in the test variant of the library.
+	packagesByFile map[string][]*FlatPackage
+	// testPackagesBySuffix maps the ID suffix of each go_test to its
+	// packages, by import path.
+	testPackagesBySuffix map[string]map[string]*FlatPackage
 }
 
 func NewPackageRegistry(pkgs ...*FlatPackage) *PackageRegistry {
 	pr := &PackageRegistry{
 		packagesByID:         map[string]*FlatPackage{},
 		packagesByImportPath: map[string]*FlatPackage{},
-		packagesByFile:       map[string]*FlatPackage{},
+		packagesByFile:       map[string][]*FlatPackage{},
+		testPackagesBySuffix: map[string]map[string]*FlatPackage{},
 	}
 	pr.Add(pkgs...)
 	return pr
@@ -37,11 +46,29 @@ func NewPackageRegistry(pkgs ...*FlatPackage) *PackageRegistry {
 func (pr *PackageRegistry) Add(pkgs ...*FlatPackage) *PackageRegistry {
 	for _, pkg := range pkgs {
 		pr.packagesByID[pkg.ID] = pkg
+		if suffix := pkg.TestSuffix(); suffix != "" {
+			// Test packages are only imported by the other packages of the
+			// same test, so they must not shadow the library.
+			if pr.testPackagesBySuffix[suffix] == nil {
+				pr.testPackagesBySuffix[suffix] = map[string]*FlatPackage{}
+			}
+			pr.testPackagesBySuffix[suffix][pkg.PkgPath] = pkg
+			continue
+		}
 		pr.packagesByImportPath[pkg.PkgPath] = pkg
 	}
 	return pr
 }
 
+func (pr *PackageRegistry) addFile(file string, pkg *FlatPackage) {
+	for _, p := range pr.packagesByFile[file] {
+		if p == pkg {
+			return
+		}
+	}
+	pr.packagesByFile[file] = append(pr.packagesByFile[file], pkg)
+}
+
 func (pr *PackageRegistry) FromPkgPath(pkgPath string) *FlatPackage {
 	return pr.packagesByImportPath[pkgPath]
 }
@@ -53,29 +80,204 @@ func (pr *PackageRegistry) Remove(pkgs ...*FlatPackage) *PackageRegistry {
 	return pr
 }
 
+// Config returns the configuration the packages were built in, or nil if
+// no package records one. Packages are normally built in a single
+// configuration; if not, the configuration of the first package by ID is
+// used.
+func (pr *PackageRegistry) Config() *BuildConfig {
+	var config *BuildConfig
+	var configID string
+	for id, pkg := range pr.packagesByID {
+		if pkg.config != nil && (config == nil || id < configID) {
+			config, configID = pkg.config, id
+		}
+	}
+	return config
+}
+
 func (pr *PackageRegistry) ResolvePaths(prf PathResolverFunc) error {
-	for _, pkg := range pr.packagesByImportPath {
+	// Packages of the standard library don't record a configuration, but
+	// they are listed for the same one as the other packages.
+	config := pr.Config()
+	for _, pkg := range pr.packagesByID {
 		pkg.ResolvePaths(prf)
-		pkg.FilterFilesForBuildTags()
-		for _, f := range pkg.CompiledGoFiles {
-			pr.packagesByFile[f] = pkg
-		}
-		for _, f := range pkg.CompiledGoFiles {
-			pr.packagesByFile[f] = pkg
+		pkg.FilterFilesForBuildTags(config)
+		for _, f := range concatStringsArrays(pkg.GoFiles, pkg.CompiledGoFiles) {
+			pr.addFile(f, pkg)
 		}
 	}
 	return nil
 }
 
-func (pr *PackageRegistry) ResolveImports() error {
-	for _, pkg := range pr.packagesByImportPath {
+// SetModules sets the module of the packages that are not part of the
+// standard library from the repository they are in.
+func (pr *PackageRegistry) SetModules(modules *Modules) {
+	for _, pkg := range pr.packagesByID {
+		if !pkg.IsStdlib() {
+			pkg.Module = modules.ForRepo(pkg.repo)
+		}
+	}
+}
+
+// ReadEmbedFiles reports the embedded files of the packages that embed
+// files. See FlatPackage.ReadEmbedFiles.
+func (pr *PackageRegistry) ReadEmbedFiles(prf PathResolverFunc) {
+	for _, pkg := range pr.packagesByID {
+		pkg.ReadEmbedFiles(prf)
+	}
+}
+
+// ExpandCgoFiles reports the files generated by cgo in the CompiledGoFiles
+// of the packages that use cgo. See FlatPackage.ExpandCgoFiles.
+func (pr *PackageRegistry) ExpandCgoFiles(prf PathResolverFunc, typecheckCgo bool) {
+	for _, pkg := range pr.packagesByID {
+		pkg.ExpandCgoFiles(prf, typecheckCgo)
+	}
+}
+
+// ApplyOverlay adds Go files that are in the overlay but not in any package
+// to the packages in the same directory that declare the same package name.
+// Test files are only added to packages that already have test files.
+// Files already in a package don't need to be changed: their overlay
+// contents are used when resolving imports.
+func (pr *PackageRegistry) ApplyOverlay(overlay Overlay) {
+	fset := token.NewFileSet()
+	for _, file := range overlay.Files() {
+		if filepath.Ext(file) != ".go" {
+			continue
+		}
+		if _, ok := pr.packagesByFile[file]; ok {
+			continue
+		}
+		f, err := overlay.parseFile(fset, file, parser.PackageClauseOnly)
+		if err != nil {
+			continue
+		}
+		isTest := strings.HasSuffix(file, "_test.go")
+		dir := filepath.Dir(file)
+		for _, pkg := range pr.packagesByID {
+			if pkg.IsStdlib() || !pkg.hasFileInDir(dir) || pkg.packageName(overlay) != f.Name.Name {
+				continue
+			}
+			if isTest && !pkg.hasTestFiles() {
+				continue
+			}
+			pkg.AddOverlayFile(file)
+			pr.addFile(file, pkg)
+		}
+	}
+}
+
+func (pr *PackageRegistry) ResolveImports(overlay Overlay) error {
+	for _, pkg := range pr.packagesByID {
+		testPkgs := pr.testPackagesBySuffix[pkg.TestSuffix()]
 		pkg.ResolveImports(func(importPath string) *FlatPackage {
+			if testPkg, ok := testPkgs[importPath]; ok {
+				return testPkg
+			}
 			return pr.FromPkgPath(importPath)
-		})
+		}, overlay)
 	}
+	pr.addRecompiledTestDeps()
 	return nil
 }
 
+// addRecompiledTestDeps adds the test variants of the dependencies of
+// external test packages that import the package under test, directly or
+// not. Like go_test does in _recompile_external_deps, those dependencies are
+// compiled again against the package under test with its internal tests, so
+// that the external test package sees a single version of it. Test variants
+// have the ID of the dependency with the test suffix, like
+// "//bar [//foo:foo_test.test]", and import the test variants of their own
+// dependencies.
+func (pr *PackageRegistry) addRecompiledTestDeps() {
+	for suffix, testPkgs := range pr.testPackagesBySuffix {
+		for _, xtest := range testPkgs {
+			if xtest.ForTest == "" || xtest.PkgPath != xtest.ForTest+"_test" {
+				continue
+			}
+			internal, ok := testPkgs[xtest.ForTest]
+			if !ok {
+				continue
+			}
+			libraryID := strings.TrimSuffix(internal.ID, suffix)
+
+			needRecompile := map[string]bool{}
+			var need func(id string) bool
+			need = func(id string) bool {
+				if id == libraryID {
+					return true
+				}
+				if n, ok := needRecompile[id]; ok {
+					return n
+				}
+				needRecompile[id] = false // Break import cycles.
+				pkg, ok := pr.packagesByID[id]
+				if !ok || pkg.IsStdlib() {
+					return false
+				}
+				for _, dep := range pkg.Imports {
+					if need(dep) {
+						needRecompile[id] = true
+						break
+					}
+				}
+				return needRecompile[id]
+			}
+
+			var variant func(id string) string
+			variant = func(id string) string {
+				if id == libraryID {
+					return internal.ID
+				}
+				if !need(id) {
+					return id
+				}
+				variantID := id + suffix
+				if _, ok := pr.packagesByID[variantID]; ok {
+					return variantID
+				}
+				pkg := *pr.packagesByID[id]
+				pkg.ID = variantID
+				pkg.ForTest = xtest.ForTest
+				pkg.Imports = make(map[string]string, len(pkg.Imports))
+				pr.packagesByID[variantID] = &pkg
+				for _, f := range pkg.CompiledGoFiles {
+					pr.addFile(f, &pkg)
+				}
+				for imp, dep := range pr.packagesByID[id].Imports {
+					pkg.Imports[imp] = variant(dep)
+				}
+				return variantID
+			}
+
+			for imp, dep := range xtest.Imports {
+				xtest.Imports[imp] = variant(dep)
+			}
+		}
+	}
+}
+
+// testPackagesOf returns the packages of the go_tests of the library pkg:
+// the library with its internal tests, the external test package, and the
+// generated main package.
+func (pr *PackageRegistry) testPackagesOf(pkg *FlatPackage) []*FlatPackage {
+	var pkgs []*FlatPackage
+	for _, testPkgs := range pr.testPackagesBySuffix {
+		internal, ok := testPkgs[pkg.PkgPath]
+		if !ok || internal.ForTest != pkg.PkgPath || !strings.HasPrefix(internal.ID, pkg.ID+" [") {
+			continue
+		}
+		pkgs = append(pkgs, internal)
+		for _, pkgPath := range []string{pkg.PkgPath + "_test", pkg.PkgPath + ".test"} {
+			if testPkg, ok := testPkgs[pkgPath]; ok {
+				pkgs = append(pkgs, testPkg)
+			}
+		}
+	}
+	return pkgs
+}
+
 func (pr *PackageRegistry) walk(acc map[string]*FlatPackage, root string) {
 	pkg := pr.packagesByID[root]
 	acc[pkg.ID] = pkg
@@ -86,7 +288,11 @@ func (pr *PackageRegistry) walk(acc map[string]*FlatPackage, root string) {
 	}
 }
 
-func (pr *PackageRegistry) Match(patterns ...string) ([]string, []*FlatPackage) {
+// Match returns the IDs of the packages matching patterns, and the packages
+// they depend on. If tests is set, the packages compiled for the go_tests of
+// the matching packages are also matched, like "go list -test" does;
+// otherwise, test packages are never matched.
+func (pr *PackageRegistry) Match(tests bool, patterns ...string) ([]string, []*FlatPackage) {
 	roots := map[string]struct{}{}
 
 	for _, pattern := range patterns {
@@ -96,6 +302,12 @@ func (pr *PackageRegistry) Match(patterns ...string) ([]string, []*FlatPackage)
 					roots[pkg.ID] = struct{}{}
 				}
 			}
+		} else if isBazelPackagePattern(pattern) {
+			for _, pkg := range pr.packagesByID {
+				if pkg.IsRoot() && !pkg.IsTest() && matchBazelPackagePattern(pattern, pkg.ID) {
+					roots[pkg.ID] = struct{}{}
+				}
+			}
 		} else if strings.HasSuffix(pattern, "/...") {
 			pkgPrefix := strings.TrimSuffix(pattern, "/...")
 			for _, pkg := range pr.packagesByImportPath {
@@ -111,8 +323,10 @@ func (pr *PackageRegistry) Match(patterns ...string) ([]string, []*FlatPackage)
 			}
 		} else if strings.HasPrefix(pattern, "file=") {
 			f := ensureAbsolutePathFromWorkspace(strings.TrimPrefix(pattern, "file="))
-			if pkg, ok := pr.packagesByFile[f]; ok {
-				roots[pkg.ID] = struct{}{}
+			for _, pkg := range pr.packagesByFile[f] {
+				if tests || !pkg.IsTest() {
+					roots[pkg.ID] = struct{}{}
+				}
 			}
 		} else {
 			if pkg, ok := pr.packagesByImportPath[pattern]; ok {
@@ -121,6 +335,18 @@ func (pr *PackageRegistry) Match(patterns ...string) ([]string, []*FlatPackage)
 		}
 	}
 
+	if tests {
+		for id := range roots {
+			pkg := pr.packagesByID[id]
+			if pkg.IsTest() {
+				continue
+			}
+			for _, testPkg := range pr.testPackagesOf(pkg) {
+				roots[testPkg.ID] = struct{}{}
+			}
+		}
+	}
+
 	walkedPackages := map[string]*FlatPackage{}
 	retRoots := make([]string, 0, len(roots))
 	for rootPkg := range roots {
@@ -0,0 +1,7 @@
+package fmt
+
+import "strings"
+
+func Sprint(a ...interface{}) string {
+	return strings.Repeat("", len(a))
+}
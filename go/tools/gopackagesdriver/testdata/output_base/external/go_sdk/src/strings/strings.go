@@ -0,0 +1,9 @@
+package strings
+
+func ToUpper(s string) string {
+	return s
+}
+
+func Repeat(s string, count int) string {
+	return s
+}
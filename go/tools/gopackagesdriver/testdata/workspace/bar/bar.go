@@ -0,0 +1,12 @@
+package bar
+
+import (
+	"C"
+	"strings"
+
+	"example.com/missing"
+)
+
+func Bar() string {
+	return strings.ToUpper(missing.Name)
+}
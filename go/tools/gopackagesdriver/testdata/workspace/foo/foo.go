@@ -0,0 +1,11 @@
+package foo
+
+import (
+	"fmt"
+
+	"example.com/repo/bar"
+)
+
+func Foo() string {
+	return fmt.Sprint(bar.Bar())
+}
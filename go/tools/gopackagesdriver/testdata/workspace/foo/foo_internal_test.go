@@ -0,0 +1,9 @@
+package foo
+
+import "testing"
+
+func TestFoo(t *testing.T) {
+	if Foo() == "" {
+		t.Fail()
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 func getenvDefault(key, defaultValue string) string {
@@ -28,6 +30,17 @@ func getenvDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getenvDuration returns the duration in the environment variable key, or
+// defaultValue if it is not set or invalid.
+func getenvDuration(key string, defaultValue time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
 func concatStringsArrays(values ...[]string) []string {
 	ret := []string{}
 	for _, v := range values {
@@ -43,6 +56,70 @@ func ensureAbsolutePathFromWorkspace(path string) string {
 	return filepath.Join(workspaceRoot, path)
 }
 
+// resolveRelativePatterns replaces the patterns relative to dir, like "."
+// and "./...", with the Bazel package patterns of the directories they name
+// in the workspace, like "//foo:all" and "//foo/...". Relative patterns
+// naming directories outside of the workspace are kept.
+func resolveRelativePatterns(dir string, patterns []string) []string {
+	ret := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		ret = append(ret, resolveRelativePattern(dir, pattern))
+	}
+	return ret
+}
+
+func resolveRelativePattern(dir, pattern string) string {
+	if pattern != "." && pattern != ".." && !strings.HasPrefix(pattern, "./") && !strings.HasPrefix(pattern, "../") {
+		return pattern
+	}
+	recursive := strings.HasSuffix(pattern, "/...")
+	rel, err := filepath.Rel(workspaceRoot, filepath.Join(dir, strings.TrimSuffix(pattern, "/...")))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return pattern
+	}
+	pkg := "//"
+	if rel != "." {
+		pkg += filepath.ToSlash(rel)
+	}
+	if !recursive {
+		return pkg + ":all"
+	}
+	if pkg == "//" {
+		return "//..."
+	}
+	return pkg + "/..."
+}
+
+// isBazelPackagePattern returns whether pattern is a pattern of Bazel
+// packages in the workspace, like "//foo:all" or "//foo/...".
+func isBazelPackagePattern(pattern string) bool {
+	return strings.HasPrefix(pattern, "//") && (strings.HasSuffix(pattern, ":all") || strings.HasSuffix(pattern, "/..."))
+}
+
+// matchBazelPackagePattern returns whether the target label is in the
+// packages matched by pattern. See isBazelPackagePattern.
+func matchBazelPackagePattern(pattern, label string) bool {
+	pkg := label
+	if i := strings.Index(label, ":"); i >= 0 {
+		pkg = label[:i]
+	}
+	if strings.HasSuffix(pattern, ":all") {
+		return pkg == strings.TrimSuffix(pattern, ":all")
+	}
+	return strings.HasPrefix(pkg+"/", strings.TrimSuffix(pattern, "..."))
+}
+
+// isStdlibImportPath returns whether an import path is in the standard
+// library, using the same rule as the go command: the first path element
+// of other packages contains a dot.
+func isStdlibImportPath(importPath string) bool {
+	first := importPath
+	if i := strings.Index(importPath, "/"); i >= 0 {
+		first = importPath[:i]
+	}
+	return !strings.Contains(first, ".")
+}
+
 func signalContext(parentCtx context.Context, signals ...os.Signal) (ctx context.Context, stop context.CancelFunc) {
 	ctx, cancel := context.WithCancel(parentCtx)
 	ch := make(chan os.Signal, 1)
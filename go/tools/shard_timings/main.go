@@ -0,0 +1,134 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command shard_timings extracts the durations of the top-level tests of a
+// go_test target from the JUnit XML files written by the test wrapper, like
+// bazel-testlogs/path/to/test/shard_1_of_4/test.xml. The resulting timing
+// file may be checked in and passed to the shard_timings attribute of
+// go_test, so that slow tests are spread across shards.
+//
+// Tests reported by several files, like the files of several runs, are
+// recorded with their average duration.
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var output = flag.String("output", "", "timing file to write. Defaults to stdout.")
+
+type xmlTestSuites struct {
+	Suites []struct {
+		TestCases []struct {
+			Name string `xml:"name,attr"`
+			Time string `xml:"time,attr"`
+		} `xml:"testcase"`
+	} `xml:"testsuite"`
+}
+
+// timings accumulates the durations of tests read from XML files.
+type timings struct {
+	total map[string]float64
+	count map[string]int
+}
+
+// read adds the durations of the top-level tests reported in the XML file
+// at path. Subtests are ignored, since they run in the shard of their parent.
+func (t *timings) read(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var suites xmlTestSuites
+	if err := xml.Unmarshal(data, &suites); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, suite := range suites.Suites {
+		for _, c := range suite.TestCases {
+			if c.Time == "" || strings.Contains(c.Name, "/") {
+				continue
+			}
+			d, err := strconv.ParseFloat(c.Time, 64)
+			if err != nil {
+				return fmt.Errorf("%s: invalid time %q for %s", path, c.Time, c.Name)
+			}
+			t.total[c.Name] += d
+			t.count[c.Name]++
+		}
+	}
+	return nil
+}
+
+// write writes the timing file, with tests sorted by name so that the
+// changes to a checked-in file are easy to review.
+func (t *timings) write(w io.Writer) error {
+	names := make([]string, 0, len(t.total))
+	for name := range t.total {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if _, err := fmt.Fprintln(w, "# Generated by shard_timings. Durations are in seconds."); err != nil {
+		return err
+	}
+	for _, name := range names {
+		d := t.total[name] / float64(t.count[name])
+		if _, err := fmt.Fprintf(w, "%s %.3f\n", name, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: shard_timings [-output file] test.xml...")
+	}
+	t := &timings{total: map[string]float64{}, count: map[string]int{}}
+	for _, path := range args {
+		if err := t.read(path); err != nil {
+			return err
+		}
+	}
+	if *output == "" {
+		return t.write(os.Stdout)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := t.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("shard_timings: ")
+	flag.Parse()
+
+	if err := run(flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
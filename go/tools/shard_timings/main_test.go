@@ -0,0 +1,65 @@
+// Copyright 2020 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestTimings(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"shard_1_of_2.xml": `<testsuites>
+  <testsuite name="example.com/pkg" tests="3" time="2.1">
+    <testcase classname="example.com/pkg" name="TestB" time="2.000"></testcase>
+    <testcase classname="example.com/pkg" name="TestB/sub" time="1.500"></testcase>
+    <testcase classname="example.com/pkg" name="TestC" time="0.100"></testcase>
+  </testsuite>
+</testsuites>`,
+		"shard_2_of_2.xml": `<testsuites>
+  <testsuite name="example.com/pkg" tests="2" time="3">
+    <testcase classname="example.com/pkg" name="TestA" time="1.000"></testcase>
+    <testcase classname="example.com/pkg" name="TestB" time="1.000"></testcase>
+    <testcase classname="example.com/pkg" name="TestD" time=""></testcase>
+  </testsuite>
+</testsuites>`,
+	}
+	tm := &timings{total: map[string]float64{}, count: map[string]int{}}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := tm.read(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tm.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# Generated by shard_timings. Durations are in seconds.
+TestA 1.000
+TestB 1.500
+TestC 0.100
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -29,7 +29,7 @@ import (
 	"github.com/bazelbuild/rules_go/go/tools/bazel"
 )
 
-var copyPath, linkPath, archivePath, nodataPath, notransitivePath string
+var copyPath, linkPath, archivePath, modulePath, nodataPath, notransitivePath string
 
 var defaultMode = runtime.GOOS + "_" + runtime.GOARCH
 
@@ -57,6 +57,7 @@ func TestMain(m *testing.M) {
 	flag.StringVar(&copyPath, "copy_path", "", "path to copied go_path")
 	flag.StringVar(&linkPath, "link_path", "", "path to symlinked go_path")
 	flag.StringVar(&archivePath, "archive_path", "", "path to archive go_path")
+	flag.StringVar(&modulePath, "module_path", "", "path to go_path in module mode")
 	flag.StringVar(&nodataPath, "nodata_path", "", "path to go_path without data")
 	flag.StringVar(&notransitivePath, "notransitive_path", "", "path to go_path without transitive dependencies")
 	flag.Parse()
@@ -122,6 +123,64 @@ func TestArchivePath(t *testing.T) {
 	checkPath(t, dir, files)
 }
 
+func TestModulePath(t *testing.T) {
+	if modulePath == "" {
+		t.Fatal("-module_path not set")
+	}
+	files := []string{
+		"go.work",
+		"-src/",
+		"-pkg/",
+		"example.com/repo/go.mod",
+		"example.com/repo/cmd/bin/bin.go",
+		"example.com/repo/pkg/lib/lib.go",
+		"example.com/repo/pkg/lib/data.txt",
+		"example.com/repo/pkg/lib/transitive/transitive.go",
+		"-example.com/repo/pkg/lib/go.mod",
+		"-example.com/repo/vendor/",
+		"example.com/repo2/go.mod",
+		"example.com/repo2/vendored.go",
+		"example.com/repo2/sub/vendored_sub.go",
+		"-example.com/repo2/sub/go.mod",
+	}
+	checkPath(t, modulePath, files)
+
+	for _, test := range []struct {
+		path, want string
+	}{
+		{path: "go.work", want: "go 1."},
+		{path: "go.work", want: `
+use (
+	./example.com/repo
+	./example.com/repo2
+)
+`},
+		{path: "example.com/repo/go.mod", want: "module example.com/repo\n"},
+		{path: "example.com/repo/go.mod", want: `
+require (
+	example.com/repo2 v0.0.0
+)
+
+replace (
+	example.com/repo2 => ../repo2
+)
+`},
+		{path: "example.com/repo2/go.mod", want: `
+replace (
+	example.com/repo => ../repo
+)
+`},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(modulePath, filepath.FromSlash(test.path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), test.want) {
+			t.Errorf("%s does not contain %q:\n%s", test.path, test.want, data)
+		}
+	}
+}
+
 func TestNoDataPath(t *testing.T) {
 	if nodataPath == "" {
 		t.Fatal("-nodata_path not set")
@@ -0,0 +1 @@
+package pack_verify_lib
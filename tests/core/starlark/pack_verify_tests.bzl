@@ -0,0 +1,63 @@
+load("@bazel_skylib//lib:unittest.bzl", "analysistest", "asserts")
+load("//go:def.bzl", "go_library")
+
+def _pack_verify_test_impl(ctx):
+    env = analysistest.begin(ctx)
+
+    actions = [a for a in analysistest.target_actions(env) if a.mnemonic == "GoCompilePkg"]
+    asserts.equals(env, 1, len(actions))
+    argv = actions[0].argv
+    if ctx.attr.want_verify == "off":
+        asserts.false(env, "-pack_verify" in argv, "-pack_verify should not be passed")
+    else:
+        asserts.true(env, "-pack_verify" in argv, "-pack_verify should be passed")
+        if "-pack_verify" in argv:
+            asserts.equals(env, ctx.attr.want_verify, argv[argv.index("-pack_verify") + 1])
+
+    return analysistest.end(env)
+
+_pack_verify_attrs = {
+    "want_verify": attr.string(mandatory = True),
+}
+
+pack_verify_default_test = analysistest.make(
+    _pack_verify_test_impl,
+    attrs = _pack_verify_attrs,
+)
+
+pack_verify_error_test = analysistest.make(
+    _pack_verify_test_impl,
+    attrs = _pack_verify_attrs,
+    config_settings = {
+        str(Label("//go/config:pack_verify")): "error",
+    },
+)
+
+def pack_verify_test_suite():
+    """Creates the test targets and test suite for the pack_verify setting."""
+    go_library(
+        name = "pack_verify_lib",
+        srcs = ["pack_verify_lib.go"],
+        importpath = "github.com/bazelbuild/rules_go/tests/core/starlark/pack_verify_lib",
+        tags = ["manual"],
+    )
+
+    pack_verify_default_test(
+        name = "pack_verify_default_test",
+        target_under_test = ":pack_verify_lib",
+        want_verify = "off",
+    )
+
+    pack_verify_error_test(
+        name = "pack_verify_error_test",
+        target_under_test = ":pack_verify_lib",
+        want_verify = "error",
+    )
+
+    native.test_suite(
+        name = "pack_verify_tests",
+        tests = [
+            ":pack_verify_default_test",
+            ":pack_verify_error_test",
+        ],
+    )